@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	apnsProductionHost  = "https://api.push.apple.com"
+	apnsDevelopmentHost = "https://api.sandbox.push.apple.com"
+
+	// APNs rejects provider tokens older than an hour
+	apnsTokenLifetime = 50 * time.Minute
+)
+
+// APNSError is the error returned by APNs for a rejected push.
+type APNSError struct {
+	Status int
+	Reason string
+}
+
+func (e *APNSError) Error() string {
+	return fmt.Sprintf("apns error %d: %s", e.Status, e.Reason)
+}
+
+// IsInvalidToken checks if the push was rejected because the device
+// token is no longer active or does not belong to the topic.
+func (e *APNSError) IsInvalidToken() bool {
+	switch e.Reason {
+	case "BadDeviceToken", "Unregistered", "DeviceTokenNotForTopic":
+		return true
+	}
+	return e.Status == http.StatusGone
+}
+
+func (e *APNSError) IsRetryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// APNSClient sends pushes directly to APNs.
+//
+// It is used for VoIP pushes which are delivered through PushKit
+// and cannot be sent through FCM.
+type APNSClient struct {
+	mutex         sync.Mutex
+	httpClient    *http.Client
+	host          string
+	topic         string
+	keyId         string
+	teamId        string
+	key           *ecdsa.PrivateKey
+	token         string
+	tokenIssuedAt time.Time
+}
+
+// initializeAPNS creates the APNs client from the environment. It returns nil
+// if APNs is not configured.
+func initializeAPNS() (*APNSClient, error) {
+	rawKey := os.Getenv("APNS_AUTH_KEY")
+	if len(rawKey) == 0 {
+		return nil, nil
+	}
+
+	keyId := os.Getenv("APNS_KEY_ID")
+	if len(keyId) == 0 {
+		return nil, fmt.Errorf("APNS_KEY_ID is not set")
+	}
+
+	teamId := os.Getenv("APNS_TEAM_ID")
+	if len(teamId) == 0 {
+		return nil, fmt.Errorf("APNS_TEAM_ID is not set")
+	}
+
+	bundleId := os.Getenv("APNS_BUNDLE_ID")
+	if len(bundleId) == 0 {
+		return nil, fmt.Errorf("APNS_BUNDLE_ID is not set")
+	}
+
+	// the auth key can either be a path to the .p8 file or its contents
+	contents, err := os.ReadFile(rawKey)
+	if err != nil {
+		contents = []byte(rawKey)
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("error reading APNs auth key: invalid PEM")
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error reading APNs auth key: %v", err)
+	}
+
+	key, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("error reading APNs auth key: not an ECDSA key")
+	}
+
+	host := apnsDevelopmentHost
+	if os.Getenv("APNS_PRODUCTION") == "1" {
+		host = apnsProductionHost
+	}
+
+	return &APNSClient{
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		host:       host,
+		topic:      bundleId + ".voip",
+		keyId:      keyId,
+		teamId:     teamId,
+		key:        key,
+	}, nil
+}
+
+func (a *APNSClient) authToken() (string, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if len(a.token) != 0 && time.Since(a.tokenIssuedAt) < apnsTokenLifetime {
+		return a.token, nil
+	}
+
+	now := time.Now()
+	jwtToken := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"iss": a.teamId,
+		"iat": now.Unix(),
+	})
+	jwtToken.Header["kid"] = a.keyId
+
+	signed, err := jwtToken.SignedString(a.key)
+	if err != nil {
+		return "", err
+	}
+
+	a.token = signed
+	a.tokenIssuedAt = now
+	return signed, nil
+}
+
+// Send sends the APNs payload of the message to its token.
+func (a *APNSClient) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	if message.APNS == nil || message.APNS.Payload == nil {
+		return "", errors.New("message has no APNs payload")
+	}
+
+	payload, err := json.Marshal(message.APNS.Payload)
+	if err != nil {
+		return "", err
+	}
+
+	return a.send(ctx, message.Token, message.APNS.Headers, payload)
+}
+
+// SendEachForMulticast sends the APNs payload of the message to each of
+// its tokens. The responses are in the same order as the tokens.
+func (a *APNSClient) SendEachForMulticast(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	if message.APNS == nil || message.APNS.Payload == nil {
+		return nil, errors.New("message has no APNs payload")
+	}
+
+	payload, err := json.Marshal(message.APNS.Payload)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &messaging.BatchResponse{
+		Responses: make([]*messaging.SendResponse, len(message.Tokens)),
+	}
+
+	for idx, token := range message.Tokens {
+		id, err := a.send(ctx, token, message.APNS.Headers, payload)
+		if err != nil {
+			resp.FailureCount++
+			resp.Responses[idx] = &messaging.SendResponse{Error: err}
+			continue
+		}
+
+		resp.SuccessCount++
+		resp.Responses[idx] = &messaging.SendResponse{Success: true, MessageID: id}
+	}
+
+	return resp, nil
+}
+
+func (a *APNSClient) send(ctx context.Context, token string, headers map[string]string, payload []byte) (string, error) {
+	authToken, err := a.authToken()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.host+"/3/device/"+token, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	req.Header.Set("authorization", "bearer "+authToken)
+	req.Header.Set("apns-topic", a.topic)
+
+	res, err := a.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(res.Body)
+		apnsErr := &APNSError{Status: res.StatusCode}
+
+		var errBody struct {
+			Reason string `json:"reason"`
+		}
+
+		if err := json.Unmarshal(body, &errBody); err == nil {
+			apnsErr.Reason = errBody.Reason
+		}
+
+		return "", apnsErr
+	}
+
+	return res.Header.Get("apns-id"), nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+	lksdk "github.com/livekit/server-sdk-go"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"golang.org/x/exp/slices"
+)
+
+// the active call of a chat is stored in the call_rooms collection:
+//
+//   - from_chat: the chat identifier (e.g. "ds:<id>")
+//   - invited_participants: the users who can join the call
+//   - participants: the users who are in the call
+//   - hosts: the users who can manage the call
+//
+// the id of the record is also the name of the livekit room.
+
+// livekitRequestTimeout is how long the requests to the livekit server may take
+var livekitRequestTimeout = 10 * time.Second
+
+// findCallRoom returns the active call room of the chat.
+func findCallRoom(dao *daos.Dao, chatIdentifier string) (*models.Record, error) {
+	return dao.FindFirstRecordByFilter("call_rooms", "from_chat={:from_chat}", dbx.Params{"from_chat": chatIdentifier})
+}
+
+// endCallRoom removes the room and revokes the rings of the call that have not been sent yet.
+func endCallRoom(dao *daos.Dao, scheduler *NotificationScheduler, room *models.Record) error {
+	if err := dao.DeleteRecord(room); err != nil {
+		return err
+	}
+
+	scheduler.CancelByTag(makeRoomNotificationTag(room.Id))
+
+	// allow the next call in the chat to ring again
+	scheduler.ForgetDedupeKey(makeIncomingCallDedupeKey(room.GetString("from_chat")))
+	return nil
+}
+
+// notifyCallRemoved notifies the users that they can no longer join the call of the
+// chat for the reason (e.g. callRemovedChatDeleted).
+func notifyCallRemoved(dao *daos.Dao, scheduler *NotificationScheduler, room *models.Record, kind *ChatKind, chatId string, userIds []string, reason string) {
+	if len(userIds) == 0 {
+		return
+	}
+
+	users, err := dao.FindRecordsByIds("users", userIds)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	scheduleNotification(scheduler, CallRemovedParams{
+		RoomId:       room.Id,
+		ChatId:       chatId,
+		FromChatType: kind.Name,
+		Reason:       reason,
+	}, findPushTargets(dao, users), time.Now(), "")
+}
+
+// callRoomSync keeps the call rooms in sync with the members of their chats.
+type callRoomSync struct {
+	scheduler    *NotificationScheduler
+	lkRoomClient *lksdk.RoomServiceClient
+}
+
+// endChatRoom ends the call of the chat and disconnects everyone in it
+// because the chat was deleted or no longer allows calls.
+func (s *callRoomSync) endChatRoom(dao *daos.Dao, kind *ChatKind, chatId string, chatDeleted bool) error {
+	room, err := findCallRoom(dao, kind.Identifier(chatId))
+	if err != nil {
+		// no active call
+		return nil
+	}
+
+	if err := endCallRoom(dao, s.scheduler, room); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), livekitRequestTimeout)
+	defer cancel()
+
+	if _, err := s.lkRoomClient.DeleteRoom(ctx, &livekit.DeleteRoomRequest{Room: room.Id}); err != nil {
+		log.Printf("[call_room:%s] Error closing room: %v\n", room.Id, err)
+	}
+
+	reason := callRemovedCallsDisabled
+	if chatDeleted {
+		reason = callRemovedChatDeleted
+	}
+
+	notifyCallRemoved(dao, s.scheduler, room, kind, chatId, room.GetStringSlice("invited_participants"), reason)
+	return nil
+}
+
+// syncChatRoom updates the invited participants and hosts of the call of the chat
+// to its current members. Members who were removed from the chat are evicted from
+// the call, and the call ends once no one is left in it.
+func (s *callRoomSync) syncChatRoom(dao *daos.Dao, kind *ChatKind, chat *models.Record) error {
+	// e.g. ds chats whose chat request is no longer accepted
+	if !kind.AllowsCalls(chat) {
+		return s.endChatRoom(dao, kind, chat.Id, false)
+	}
+
+	room, err := findCallRoom(dao, kind.Identifier(chat.Id))
+	if err != nil {
+		// no active call
+		return nil
+	}
+
+	memberIds := kind.MemberIds(dao, chat)
+	isMember := func(id string) bool {
+		return slices.Contains(memberIds, id)
+	}
+
+	removedIds := slices.DeleteFunc(room.GetStringSlice("invited_participants"), isMember)
+	participants := room.GetStringSlice("participants")
+	evictedIds := slices.DeleteFunc(slices.Clone(participants), isMember)
+	participants = slices.DeleteFunc(participants, func(id string) bool {
+		return !isMember(id)
+	})
+
+	// the hosts of the chat are always hosts of the call
+	hosts := slices.DeleteFunc(room.GetStringSlice("hosts"), func(id string) bool {
+		return !isMember(id)
+	})
+	for _, hostId := range kind.HostIds(dao, chat) {
+		if !slices.Contains(hosts, hostId) {
+			hosts = append(hosts, hostId)
+		}
+	}
+
+	if len(participants) == 0 {
+		if err := endCallRoom(dao, s.scheduler, room); err != nil {
+			return err
+		}
+	} else {
+		room.Set("invited_participants", memberIds)
+		room.Set("participants", participants)
+		room.Set("hosts", hosts)
+
+		if err := dao.SaveRecord(room); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), livekitRequestTimeout)
+	defer cancel()
+
+	for _, userId := range evictedIds {
+		log.Printf("[call_room:%s] Evicting %s\n", room.Id, userId)
+
+		// the identity of the participant is the user id
+		if _, err := s.lkRoomClient.RemoveParticipant(ctx, &livekit.RoomParticipantIdentity{
+			Room:     room.Id,
+			Identity: userId,
+		}); err != nil {
+			log.Printf("[call_room:%s] Error evicting %s: %v\n", room.Id, userId, err)
+		}
+	}
+
+	notifyCallRemoved(dao, s.scheduler, room, kind, chat.Id, removedIds, callRemovedMemberRemoved)
+	return nil
+}
+
+// bindCallRoomSync syncs the call rooms on every change of the chat lists, including
+// the ones made by the admin UI, migrations and internal saves, which is why
+// model hooks are used instead of the record request hooks.
+func bindCallRoomSync(app core.App, scheduler *NotificationScheduler, lkRoomClient *lksdk.RoomServiceClient) {
+	roomSync := &callRoomSync{
+		scheduler:    scheduler,
+		lkRoomClient: lkRoomClient,
+	}
+
+	collectionNames := chatListCollectionNames()
+
+	syncChatRoom := func(e *core.ModelEvent) error {
+		chat, ok := e.Model.(*models.Record)
+		if !ok {
+			return nil
+		}
+
+		kind, err := findChatKindByCollection(chat.Collection().Name)
+		if err != nil {
+			return nil
+		}
+
+		// do not return error or it will cause the save to fail
+		if err := roomSync.syncChatRoom(e.Dao, kind, chat); err != nil {
+			log.Println(err)
+		}
+		return nil
+	}
+
+	app.OnModelAfterCreate(collectionNames...).Add(syncChatRoom)
+	app.OnModelAfterUpdate(collectionNames...).Add(syncChatRoom)
+
+	app.OnModelAfterDelete(collectionNames...).Add(func(e *core.ModelEvent) error {
+		chat, ok := e.Model.(*models.Record)
+		if !ok {
+			return nil
+		}
+
+		kind, err := findChatKindByCollection(chat.Collection().Name)
+		if err != nil {
+			return nil
+		}
+
+		if err := roomSync.endChatRoom(e.Dao, kind, chat.Id, true); err != nil {
+			log.Println(err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"golang.org/x/exp/slices"
+)
+
+// messageBurstDelay is how long a message notification waits for the
+// next message so that bursts of messages are sent as one notification
+var messageBurstDelay = 3 * time.Second
+
+// messageBurstWindow is how long since the last message of a chat
+// before its unseen messages are counted from zero again
+var messageBurstWindow = 2 * time.Minute
+
+// maxMessagePreviewLength is the number of characters of a message shown in
+// its notification. Longer messages would not fit in the push payload.
+var maxMessagePreviewLength = 200
+
+// messagePreview returns the text of the message shown in its notification.
+func messagePreview(content string) string {
+	runes := []rune(strings.TrimSpace(content))
+	if len(runes) <= maxMessagePreviewLength {
+		return string(runes)
+	}
+	return strings.TrimSpace(string(runes[:maxMessagePreviewLength])) + "…"
+}
+
+func makeChatNotificationTag(chatIdentifier string) string {
+	return "chat:" + chatIdentifier
+}
+
+// messageBurst counts the messages of a chat that each member has not seen.
+type messageBurst struct {
+	unseen        map[string]int
+	lastMessageAt time.Time
+}
+
+type messageBursts struct {
+	mutex  sync.Mutex
+	bursts map[string]*messageBurst
+}
+
+// add counts the message for the recipients and returns the number of
+// messages each of them has not seen. The sender has seen all of them.
+func (b *messageBursts) add(chatIdentifier string, senderId string, recipientIds []string) map[string]int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+	for key, burst := range b.bursts {
+		if now.Sub(burst.lastMessageAt) > messageBurstWindow {
+			delete(b.bursts, key)
+		}
+	}
+
+	burst, exists := b.bursts[chatIdentifier]
+	if !exists {
+		burst = &messageBurst{unseen: map[string]int{}}
+		b.bursts[chatIdentifier] = burst
+	}
+
+	burst.lastMessageAt = now
+	delete(burst.unseen, senderId)
+
+	unseen := make(map[string]int, len(recipientIds))
+	for _, recipientId := range recipientIds {
+		burst.unseen[recipientId]++
+		unseen[recipientId] = burst.unseen[recipientId]
+	}
+
+	return unseen
+}
+
+// findMutedUserIds returns which of the users have muted the chat.
+// Mutes without an until date never expire.
+func findMutedUserIds(dao *daos.Dao, chatIdentifier string, userIds []string) map[string]bool {
+	muted := map[string]bool{}
+	if len(userIds) == 0 {
+		return muted
+	}
+
+	mutes, err := dao.FindRecordsByFilter("chat_mutes", "chat={:chat} && (until='' || until>{:now})", "", 0, 0, dbx.Params{
+		"chat": chatIdentifier,
+		"now":  types.NowDateTime().String(),
+	})
+	if err != nil {
+		log.Println(err)
+		return muted
+	}
+
+	for _, mute := range mutes {
+		if userId := mute.GetString("user"); slices.Contains(userIds, userId) {
+			muted[userId] = true
+		}
+	}
+
+	return muted
+}
+
+// setMessageMentions parses the mentions of the members in the content
+// of a community message and stores them in the message.
+func setMessageMentions(dao *daos.Dao, message *models.Record, sender *models.Record) error {
+	chat, err := communityChatKind.FindChat(dao, message.GetString("chat"))
+	if err != nil {
+		return err
+	}
+
+	members, err := dao.FindRecordsByIds("users", communityChatKind.MemberIds(dao, chat))
+	if err != nil {
+		return err
+	}
+
+	membersByUsername := map[string]*models.Record{}
+	for _, member := range members {
+		membersByUsername[strings.ToLower(member.Username())] = member
+	}
+
+	// only the community account can notify everyone
+	canMentionEveryone := slices.Contains(communityChatKind.HostIds(dao, chat), sender.Id)
+
+	message.Set("mentions", parseMentions(message.GetString("content"), membersByUsername, canMentionEveryone))
+	return nil
+}
+
+// notifyChatMessage notifies the members of the chat except the sender
+// about the new message. Pending notifications of the chat are replaced
+// by one which counts the messages that each recipient has not seen.
+//
+// Mentioned members are notified separately, even if they have muted the chat.
+func notifyChatMessage(app core.App, scheduler *NotificationScheduler, bursts *messageBursts, kind *ChatKind, message *models.Record, sender *models.Record) error {
+	chat, err := kind.FindChat(app.Dao(), message.GetString("chat"))
+	if err != nil {
+		return err
+	}
+
+	chatIdentifier := kind.Identifier(chat.Id)
+	memberIds := kind.MemberIds(app.Dao(), chat)
+	muted := findMutedUserIds(app.Dao(), chatIdentifier, memberIds)
+
+	// the mentions are only parsed by the server in community chats
+	mentions := []chatMention{}
+	if kind == communityChatKind {
+		if err := unmarshalOptionalJSONField(message, "mentions", &mentions); err != nil {
+			log.Println(err)
+		}
+	}
+
+	mentionedIds := mentionedUserIds(mentions, memberIds, kind.HostIds(app.Dao(), chat))
+	mentionedIds = slices.DeleteFunc(mentionedIds, func(id string) bool {
+		return id == sender.Id
+	})
+
+	recipientIds := []string{}
+	for _, memberId := range memberIds {
+		if memberId != sender.Id && !muted[memberId] && !slices.Contains(mentionedIds, memberId) {
+			recipientIds = append(recipientIds, memberId)
+		}
+	}
+
+	unseen := bursts.add(chatIdentifier, sender.Id, recipientIds)
+	scheduler.CancelByTag(makeChatNotificationTag(chatIdentifier))
+
+	imageUrl := ""
+	if avatar := sender.GetString("avatar"); len(avatar) != 0 {
+		gotImageUrl, err := url.JoinPath(app.Settings().Meta.AppUrl, "api/files/users", sender.Id, avatar)
+		if err == nil {
+			imageUrl = gotImageUrl
+		}
+	}
+
+	if len(mentionedIds) != 0 {
+		mentioned, err := app.Dao().FindRecordsByIds("users", mentionedIds)
+		if err != nil {
+			return err
+		}
+
+		scheduleNotification(scheduler, ChatMentionParams{
+			Sender:         sender,
+			SenderImageUrl: imageUrl,
+			MessageId:      message.Id,
+			Text:           messagePreview(message.GetString("content")),
+			ChatId:         chat.Id,
+			FromChatType:   kind.Name,
+		}, findPushTargets(app.Dao(), mentioned), time.Now(), "")
+	}
+
+	if len(recipientIds) == 0 {
+		return nil
+	}
+
+	recipients, err := app.Dao().FindRecordsByIds("users", recipientIds)
+	if err != nil {
+		return err
+	}
+
+	// recipients who have not seen the same number of messages share a notification
+	recipientsByCount := map[int][]*models.Record{}
+	for _, recipient := range recipients {
+		count := unseen[recipient.Id]
+		recipientsByCount[count] = append(recipientsByCount[count], recipient)
+	}
+
+	for count, countRecipients := range recipientsByCount {
+		scheduleNotification(scheduler, ChatMessageParams{
+			Sender:         sender,
+			SenderImageUrl: imageUrl,
+			MessageId:      message.Id,
+			Text:           messagePreview(message.GetString("content")),
+			ChatId:         chat.Id,
+			FromChatType:   kind.Name,
+			Count:          count,
+		}, findPushTargets(app.Dao(), countRecipients), time.Now().Add(messageBurstDelay), "", makeChatNotificationTag(chatIdentifier))
+	}
+
+	return nil
+}
+
+func bindChatMessageNotifications(app core.App, scheduler *NotificationScheduler) {
+	bursts := &messageBursts{bursts: map[string]*messageBurst{}}
+
+	findSender := func(e *core.RecordCreateEvent) *models.Record {
+		sender := apis.RequestInfo(e.HttpContext).AuthRecord
+		if senderId := e.Record.GetString("sender"); len(senderId) != 0 && (sender == nil || sender.Id != senderId) {
+			sender, _ = app.Dao().FindRecordById("users", senderId)
+		}
+		return sender
+	}
+
+	// mentions are only supported in community chats
+	app.OnRecordBeforeCreateRequest(communityChatKind.MessageCollection).Add(func(e *core.RecordCreateEvent) error {
+		// the mentions sent by the client are never trusted
+		e.Record.Set("mentions", []chatMention{})
+
+		sender := findSender(e)
+		if sender == nil {
+			return nil
+		}
+
+		if err := setMessageMentions(app.Dao(), e.Record, sender); err != nil {
+			log.Println(err)
+		}
+
+		return nil
+	})
+
+	app.OnRecordAfterCreateRequest(chatMessageCollectionNames()...).Add(func(e *core.RecordCreateEvent) error {
+		sender := findSender(e)
+		if sender == nil {
+			return nil
+		}
+
+		kind, err := findChatKindByCollection(e.Collection.Name)
+		if err != nil {
+			return nil
+		}
+
+		// do not return error or it will cause the message to fail.
+		// the unread counts are updated first so that they are included in the badges
+		if err := countChatMessage(app.Dao(), kind, e.Record, sender); err != nil {
+			log.Println(err)
+		}
+
+		if err := notifyChatMessage(app, scheduler, bursts, kind, e.Record, sender); err != nil {
+			log.Println(err)
+		}
+
+		return nil
+	})
+}
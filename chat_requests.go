@@ -0,0 +1,182 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// statuses of the chat request of a ds chat. Chats created before
+// requests had a status are considered accepted.
+const (
+	chatRequestStatusPending   = "pending"
+	chatRequestStatusAccepted  = "accepted"
+	chatRequestStatusDeclined  = "declined"
+	chatRequestStatusWithdrawn = "withdrawn"
+)
+
+type chatRequestBody struct {
+	To string `json:"to" form:"to"`
+}
+
+// isChatRequestAccepted checks if the members of the ds chat are allowed to talk.
+func isChatRequestAccepted(chat *models.Record) bool {
+	status := chat.GetString("status")
+	return len(status) == 0 || status == chatRequestStatusAccepted
+}
+
+// findUserProfile returns the parent or community profile of the user.
+func findUserProfile(dao *daos.Dao, user *models.Record) (*models.Record, error) {
+	return dao.FindFirstRecordByData("users_"+user.GetString("label"), "users", user.Id)
+}
+
+// notifyChatRequest notifies the user of the profile about the new status
+// of the chat request.
+func notifyChatRequest(app core.App, scheduler *NotificationScheduler, chat *models.Record, actor *models.Record, recipientProfile *models.Record) error {
+	recipient, err := app.Dao().FindRecordById("users", recipientProfile.GetString("users"))
+	if err != nil {
+		return err
+	}
+
+	imageUrl := ""
+	if avatar := actor.GetString("avatar"); len(avatar) != 0 {
+		gotImageUrl, err := url.JoinPath(app.Settings().Meta.AppUrl, "api/files/users", actor.Id, avatar)
+		if err == nil {
+			imageUrl = gotImageUrl
+		}
+	}
+
+	scheduleNotification(scheduler, ChatRequestParams{
+		Actor:         actor,
+		ActorImageUrl: imageUrl,
+		ChatId:        chat.Id,
+		Status:        chat.GetString("status"),
+	}, findPushTargets(app.Dao(), []*models.Record{recipient}), time.Now(), "")
+
+	return nil
+}
+
+func bindChatRequestApi(app core.App, e *core.ServeEvent, scheduler *NotificationScheduler) {
+	e.Router.Add("POST", "/api/chat_requests", func(c echo.Context) error {
+		var body chatRequestBody
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("invalid request body", err)
+		}
+
+		user := apis.RequestInfo(c).AuthRecord
+		if len(body.To) == 0 || body.To == user.Id {
+			return apis.NewBadRequestError("to is required", nil)
+		}
+
+		to, err := app.Dao().FindRecordById("users", body.To)
+		if err != nil {
+			return apis.NewNotFoundError("user not found", nil)
+		}
+
+		// direct chats are only between parents
+		if user.GetString("label") != "parent" {
+			return apis.NewBadRequestError("only parents can send chat requests", nil)
+		} else if to.GetString("label") != "parent" {
+			return apis.NewBadRequestError("chat requests can only be sent to parents", nil)
+		}
+
+		fromProfile, err := findUserProfile(app.Dao(), user)
+		if err != nil {
+			return apis.NewBadRequestError("user has no profile", nil)
+		}
+
+		toProfile, err := findUserProfile(app.Dao(), to)
+		if err != nil {
+			return apis.NewBadRequestError("recipient has no profile", nil)
+		}
+
+		// reuse the chat of a previous request between the two in either direction
+		chat, err := app.Dao().FindFirstRecordByFilter(dsChatKind.Collection,
+			"(chatRequestBy={:from} && chatRequestTo={:to}) || (chatRequestBy={:to} && chatRequestTo={:from})",
+			dbx.Params{"from": fromProfile.Id, "to": toProfile.Id})
+		if err == nil {
+			switch chat.GetString("status") {
+			case chatRequestStatusPending:
+				return apis.NewBadRequestError("a chat request is already pending", nil)
+			case chatRequestStatusDeclined, chatRequestStatusWithdrawn:
+			default:
+				return apis.NewBadRequestError("chat already exists", nil)
+			}
+		} else {
+			collection, err := app.Dao().FindCollectionByNameOrId(dsChatKind.Collection)
+			if err != nil {
+				return err
+			}
+			chat = models.NewRecord(collection)
+		}
+
+		chat.Set("chatRequestBy", fromProfile.Id)
+		chat.Set("chatRequestTo", toProfile.Id)
+		chat.Set("status", chatRequestStatusPending)
+
+		if err := app.Dao().SaveRecord(chat); err != nil {
+			return apis.NewBadRequestError("failed to send chat request", err)
+		}
+
+		if err := notifyChatRequest(app, scheduler, chat, user, toProfile); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, chat)
+	}, apis.RequireRecordAuth())
+
+	// the recipient accepts or declines the request while
+	// the sender can withdraw it as long as it is pending
+	updateStatus := func(status string, byRecipient bool) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			chat, err := app.Dao().FindRecordById(dsChatKind.Collection, c.PathParam("id"))
+			if err != nil {
+				return apis.NewNotFoundError("chat request not found", nil)
+			}
+
+			if chat.GetString("status") != chatRequestStatusPending {
+				return apis.NewBadRequestError("chat request is not pending", nil)
+			}
+
+			user := apis.RequestInfo(c).AuthRecord
+			if errs := app.Dao().ExpandRecord(chat, []string{"chatRequestBy", "chatRequestTo"}, nil); len(errs) != 0 {
+				return apis.NewNotFoundError("chat request not found", nil)
+			}
+
+			actorProfile, otherProfile := chat.ExpandedOne("chatRequestBy"), chat.ExpandedOne("chatRequestTo")
+			if byRecipient {
+				actorProfile, otherProfile = otherProfile, actorProfile
+			}
+
+			if actorProfile == nil || otherProfile == nil {
+				return apis.NewNotFoundError("chat request not found", nil)
+			}
+
+			if actorProfile.GetString("users") != user.Id {
+				return apis.NewForbiddenError("forbidden to update this chat request", nil)
+			}
+
+			chat.Set("status", status)
+			if err := app.Dao().SaveRecord(chat); err != nil {
+				return apis.NewBadRequestError("failed to update chat request", err)
+			}
+
+			if err := notifyChatRequest(app, scheduler, chat, user, otherProfile); err != nil {
+				return err
+			}
+
+			return c.JSON(http.StatusOK, chat)
+		}
+	}
+
+	e.Router.Add("POST", "/api/chat_requests/:id/accept", updateStatus(chatRequestStatusAccepted, true), apis.RequireRecordAuth())
+	e.Router.Add("POST", "/api/chat_requests/:id/decline", updateStatus(chatRequestStatusDeclined, true), apis.RequireRecordAuth())
+	e.Router.Add("POST", "/api/chat_requests/:id/withdraw", updateStatus(chatRequestStatusWithdrawn, false), apis.RequireRecordAuth())
+}
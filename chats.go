@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"golang.org/x/exp/slices"
+)
+
+// ChatKind describes a type of chat. Call routes and hooks resolve the
+// collections, identifiers and members of a chat through its kind.
+type ChatKind struct {
+	// Name is the type of the chat used in the from_chat_type param,
+	// notification payloads and as the prefix of the chat identifiers.
+	Name string
+
+	// Aliases are the legacy names of the type accepted in the params.
+	Aliases []string
+
+	// Collection is the chat list collection of the chats.
+	Collection string
+
+	// MessageCollection is the collection of the messages of the chats. Each
+	// message has a "chat" relation to its chat, the "sender" user, its
+	// "content" and the "mentions" parsed from its content.
+	MessageCollection string
+
+	// Expands are the relations of the chat used by the resolvers.
+	Expands []string
+
+	// Members returns the user ids of the members of the expanded chat.
+	Members func(chat *models.Record) []string
+
+	// Hosts returns the user ids of the hosts of the expanded chat.
+	// Chats of the kind have no hosts if it is nil.
+	Hosts func(chat *models.Record) []string
+
+	// CanCall checks if calls are allowed in the chat.
+	// Calls are always allowed if it is nil.
+	CanCall func(chat *models.Record) bool
+}
+
+// Identifier returns the identifier of the chat (e.g. "ds:<id>").
+func (k *ChatKind) Identifier(chatId string) string {
+	return makeChatIdentifier(k.Name, chatId)
+}
+
+// FindChat returns the chat of the kind.
+func (k *ChatKind) FindChat(dao *daos.Dao, chatId string) (*models.Record, error) {
+	return dao.FindRecordById(k.Collection, chatId)
+}
+
+// MemberIds returns the user ids of the members of the chat.
+func (k *ChatKind) MemberIds(dao *daos.Dao, chat *models.Record) []string {
+	dao.ExpandRecord(chat, k.Expands, nil)
+	return k.Members(chat)
+}
+
+// HostIds returns the user ids of the hosts of the chat.
+func (k *ChatKind) HostIds(dao *daos.Dao, chat *models.Record) []string {
+	if k.Hosts == nil {
+		return []string{}
+	}
+
+	dao.ExpandRecord(chat, k.Expands, nil)
+	return k.Hosts(chat)
+}
+
+// AllowsCalls checks if the members of the chat can call each other.
+func (k *ChatKind) AllowsCalls(chat *models.Record) bool {
+	return k.CanCall == nil || k.CanCall(chat)
+}
+
+// chatKinds are the registered chat kinds keyed by their names and aliases.
+var chatKinds = map[string]*ChatKind{}
+
+// chatKindList are the registered chat kinds in the order of their registration.
+var chatKindList = []*ChatKind{}
+
+func registerChatKind(kind *ChatKind) *ChatKind {
+	for _, name := range append([]string{kind.Name}, kind.Aliases...) {
+		if _, exists := chatKinds[name]; exists {
+			panic(fmt.Sprintf("chat kind %q is already registered", name))
+		}
+		chatKinds[name] = kind
+	}
+
+	chatKindList = append(chatKindList, kind)
+	return kind
+}
+
+// findChatKind returns the chat kind of the name or alias.
+func findChatKind(name string) (*ChatKind, error) {
+	kind, ok := chatKinds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown chat kind %q", name)
+	}
+	return kind, nil
+}
+
+// findChatKindByCollection returns the chat kind whose chats or messages
+// are stored in the collection.
+func findChatKindByCollection(collectionName string) (*ChatKind, error) {
+	for _, kind := range chatKindList {
+		if kind.Collection == collectionName || kind.MessageCollection == collectionName {
+			return kind, nil
+		}
+	}
+	return nil, fmt.Errorf("no chat kind is stored in %q", collectionName)
+}
+
+// chatListCollectionNames returns the chat list collections of the chat kinds.
+func chatListCollectionNames() []string {
+	names := make([]string, len(chatKindList))
+	for idx, kind := range chatKindList {
+		names[idx] = kind.Collection
+	}
+	return names
+}
+
+// chatMessageCollectionNames returns the message collections of the chat kinds.
+func chatMessageCollectionNames() []string {
+	names := []string{}
+	for _, kind := range chatKindList {
+		if len(kind.MessageCollection) != 0 {
+			names = append(names, kind.MessageCollection)
+		}
+	}
+	return names
+}
+
+// expandedUserIds returns the users of the profiles expanded in the fields of the record.
+func expandedUserIds(record *models.Record, fields ...string) []string {
+	userIds := []string{}
+	for _, field := range fields {
+		for _, profile := range record.ExpandedAll(field) {
+			if userId := profile.GetString("users"); !slices.Contains(userIds, userId) {
+				userIds = append(userIds, userId)
+			}
+		}
+	}
+	return userIds
+}
+
+// dsChatKind are the chats between two users who sent and received a chat request.
+var dsChatKind = registerChatKind(&ChatKind{
+	Name:              "ds",
+	Aliases:           []string{"chum"},
+	Collection:        "chat_list_ds",
+	MessageCollection: "chat_messages_ds",
+	Expands:           []string{"chatRequestTo", "chatRequestBy"},
+	Members: func(chat *models.Record) []string {
+		return expandedUserIds(chat, "chatRequestTo", "chatRequestBy")
+	},
+	CanCall: isChatRequestAccepted,
+})
+
+// parentChatKind are the chats between parents.
+var parentChatKind = registerChatKind(&ChatKind{
+	Name:              "parent",
+	Collection:        "chat_list_parent",
+	MessageCollection: "chat_messages_parent",
+	Expands:           []string{"parents"},
+	Members: func(chat *models.Record) []string {
+		return expandedUserIds(chat, "parents")
+	},
+})
+
+// communityChatKind are the chats of a community account with its parents.
+// The community account hosts the chat.
+var communityChatKind = registerChatKind(&ChatKind{
+	Name:              "community",
+	Collection:        "chat_list_gc",
+	MessageCollection: "chat_messages_gc",
+	Expands:           []string{"community", "parents"},
+	Members: func(chat *models.Record) []string {
+		return expandedUserIds(chat, "community", "parents")
+	},
+	Hosts: func(chat *models.Record) []string {
+		return expandedUserIds(chat, "community")
+	},
+})
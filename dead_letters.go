@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// storeDeadLetter saves the notification that kept failing so that
+// it can be inspected and re-sent later.
+func storeDeadLetter(dao *daos.Dao, notif *ScheduledNotification, lastErr error) error {
+	collection, err := dao.FindCollectionByNameOrId("notification_dead_letters")
+	if err != nil {
+		return err
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("notification_id", notif.Id)
+	record.Set("kind", notif.Kind)
+	record.Set("recipients", notif.Recipients)
+	record.Set("tags", notif.Tags)
+	record.Set("transport", notif.Transport)
+	record.Set("attempts", notif.Attempts)
+
+	if notif.Message != nil {
+		record.Set("tokens", []string{notif.Message.Token})
+		record.Set("message", notif.Message)
+	} else if notif.MulticastMessage != nil {
+		record.Set("tokens", notif.MulticastMessage.Tokens)
+		record.Set("message", notif.MulticastMessage)
+	}
+
+	if lastErr != nil {
+		record.Set("error", lastErr.Error())
+	}
+
+	return dao.SaveRecord(record)
+}
+
+// findDeadLetter returns the last stored dead letter of the notification
+// with the id. The failed tokens of the notification are the tokens of
+// the dead letter.
+func findDeadLetter(dao *daos.Dao, id string) (*ScheduledNotification, error) {
+	records, err := dao.FindRecordsByFilter("notification_dead_letters", "notification_id = {:id}", "-created", 1, 0, dbx.Params{"id": id})
+	if err != nil {
+		return nil, err
+	} else if len(records) == 0 {
+		return nil, errors.New("dead letter not found")
+	}
+
+	record := records[0]
+	notif := &ScheduledNotification{
+		Id:           id,
+		Kind:         record.GetString("kind"),
+		Status:       notificationStatusDead,
+		Recipients:   record.GetStringSlice("recipients"),
+		Tags:         record.GetStringSlice("tags"),
+		Transport:    record.GetString("transport"),
+		Attempts:     record.GetInt("attempts"),
+		FailedTokens: record.GetStringSlice("tokens"),
+		LastError:    record.GetString("error"),
+	}
+
+	// single and multicast messages are stored in the same field
+	fields := map[string]json.RawMessage{}
+	if err := unmarshalOptionalJSONField(record, "message", &fields); err != nil {
+		return nil, err
+	}
+
+	if _, isMulticast := fields["Tokens"]; isMulticast {
+		err = record.UnmarshalJSONField("message", &notif.MulticastMessage)
+	} else if len(fields) != 0 {
+		err = record.UnmarshalJSONField("message", &notif.Message)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if notif.Message == nil && notif.MulticastMessage == nil {
+		return nil, errors.New("dead letter has no message")
+	}
+
+	return notif, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/cron"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"golang.org/x/exp/slices"
+)
+
+// deviceExpiry is how long a device can go without being seen
+// before it is removed. Devices are seen when they register (which
+// the app does on every launch) and when they report receipts.
+var deviceExpiry = 60 * 24 * time.Hour
+
+// deviceSeenInterval is how often the last_seen of a device is updated
+// so that frequent requests do not write to the device each time
+var deviceSeenInterval = time.Hour
+
+var validDevicePlatforms = []string{platformAndroid, platformIOS, platformWeb}
+
+// transports which devices can register a token for
+var validDeviceTransports = []string{transportFCM, transportUnifiedPush}
+
+type deviceRegistration struct {
+	Token      string `json:"token" form:"token"`
+	Platform   string `json:"platform" form:"platform"`
+	Transport  string `json:"transport" form:"transport"`
+	VoIPToken  string `json:"voip_token" form:"voip_token"`
+	AppVersion string `json:"app_version" form:"app_version"`
+	Locale     string `json:"locale" form:"locale"`
+	Timezone   string `json:"timezone" form:"timezone"`
+}
+
+func bindDeviceApi(app core.App, e *core.ServeEvent) {
+	e.Router.Add("POST", "/api/devices/register", func(c echo.Context) error {
+		var body deviceRegistration
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("invalid request body", err)
+		}
+
+		if len(body.Token) == 0 {
+			return apis.NewBadRequestError("token is required", nil)
+		}
+
+		if !slices.Contains(validDevicePlatforms, body.Platform) {
+			return apis.NewBadRequestError("invalid platform", nil)
+		}
+
+		if len(body.VoIPToken) != 0 && body.Platform != platformIOS {
+			return apis.NewBadRequestError("voip_token is only supported on ios", nil)
+		}
+
+		if len(body.Transport) == 0 {
+			body.Transport = transportFCM
+		} else if !slices.Contains(validDeviceTransports, body.Transport) {
+			return apis.NewBadRequestError("invalid transport", nil)
+		}
+
+		// unifiedpush tokens are the endpoint urls of the device
+		if body.Transport == transportUnifiedPush {
+			if body.Platform != platformAndroid {
+				return apis.NewBadRequestError("unifiedpush is only supported on android", nil)
+			}
+
+			if _, err := parseUnifiedPushEndpoint(body.Token); err != nil {
+				return apis.NewBadRequestError("unifiedpush token must be an https endpoint", nil)
+			}
+		}
+
+		// timezones are IANA names (e.g. "Asia/Manila")
+		if len(body.Timezone) != 0 {
+			if _, err := time.LoadLocation(body.Timezone); err != nil {
+				return apis.NewBadRequestError("invalid timezone", nil)
+			}
+		}
+
+		user := apis.RequestInfo(c).AuthRecord
+
+		// the same token may have been registered by a different
+		// user who previously logged in on the device
+		device, err := app.Dao().FindFirstRecordByData("devices", "token", body.Token)
+		if err != nil {
+			collection, err := app.Dao().FindCollectionByNameOrId("devices")
+			if err != nil {
+				return err
+			}
+
+			device = models.NewRecord(collection)
+			device.Set("token", body.Token)
+		}
+
+		device.Set("user", user.Id)
+		device.Set("platform", body.Platform)
+		device.Set("transport", body.Transport)
+		device.Set("voip_token", body.VoIPToken)
+		device.Set("app_version", body.AppVersion)
+		device.Set("locale", body.Locale)
+		device.Set("timezone", body.Timezone)
+		device.Set("last_seen", types.NowDateTime())
+
+		if err := app.Dao().SaveRecord(device); err != nil {
+			return apis.NewBadRequestError("failed to register device", err)
+		}
+
+		return c.JSON(http.StatusOK, device)
+	}, apis.RequireRecordAuth())
+
+	e.Router.Add("POST", "/api/devices/unregister", func(c echo.Context) error {
+		var body deviceRegistration
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("invalid request body", err)
+		}
+
+		if len(body.Token) == 0 {
+			return apis.NewBadRequestError("token is required", nil)
+		}
+
+		user := apis.RequestInfo(c).AuthRecord
+		device, err := app.Dao().FindFirstRecordByFilter("devices", "token={:token} && user={:user}", dbx.Params{
+			"token": body.Token,
+			"user":  user.Id,
+		})
+		if err != nil {
+			return apis.NewNotFoundError("device not found", nil)
+		}
+
+		if err := app.Dao().DeleteRecord(device); err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "ok",
+		})
+	}, apis.RequireRecordAuth())
+}
+
+// findPushTargets returns the push targets of the devices of the users.
+//
+// Users who have not registered a device yet fall back to the tokens
+// stored on their user record.
+func findPushTargets(dao *daos.Dao, users []*models.Record) []pushTarget {
+	if len(users) == 0 {
+		return nil
+	}
+
+	userIds := make([]string, len(users))
+	ids := make([]any, len(users))
+	for idx, user := range users {
+		userIds[idx] = user.Id
+		ids[idx] = user.Id
+	}
+
+	devices, err := dao.FindRecordsByExpr("devices", dbx.In("user", ids...))
+	if err != nil {
+		log.Println(err)
+	}
+
+	devicesByUser := map[string][]*models.Record{}
+	for _, device := range devices {
+		userId := device.GetString("user")
+		devicesByUser[userId] = append(devicesByUser[userId], device)
+	}
+
+	targets := []pushTarget{}
+	for _, user := range users {
+		userDevices, hasDevices := devicesByUser[user.Id]
+		if !hasDevices {
+			targets = append(targets, userPushTargets(user)...)
+			continue
+		}
+
+		for _, device := range userDevices {
+			locale := device.GetString("locale")
+			if len(locale) == 0 {
+				locale = user.GetString("locale")
+			}
+
+			timezone := device.GetString("timezone")
+			if len(timezone) == 0 {
+				timezone = user.GetString("timezone")
+			}
+
+			transport := device.GetString("transport")
+			if len(transport) == 0 {
+				transport = transportFCM
+			}
+
+			targets = append(targets, pushTarget{
+				UserId:    user.Id,
+				Token:     device.GetString("token"),
+				Platform:  device.GetString("platform"),
+				Transport: transport,
+				Locale:    locale,
+				Timezone:  timezone,
+				VoIPToken: device.GetString("voip_token"),
+			})
+		}
+	}
+
+	// include the unread messages of the users for the app icon badge
+	totals, err := findUnreadTotals(dao, userIds)
+	if err != nil {
+		log.Println(err)
+	}
+
+	for idx, target := range targets {
+		targets[idx].Badge = totals[target.UserId]
+	}
+
+	return targets
+}
+
+// removeDeviceToken removes the device that owns the token. For VoIP
+// tokens, only the VoIP token is removed from the device.
+func removeDeviceToken(dao *daos.Dao, token string) error {
+	devices, err := dao.FindRecordsByFilter("devices", "token={:token} || voip_token={:token}", "", 0, 0, dbx.Params{"token": token})
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if device.GetString("token") == token {
+			if err := dao.DeleteRecord(device); err != nil {
+				return err
+			}
+			continue
+		}
+
+		device.Set("voip_token", "")
+		if err := dao.SaveRecord(device); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markDeviceSeen updates the last_seen of the device unless
+// it has been updated recently.
+func markDeviceSeen(dao *daos.Dao, device *models.Record) error {
+	if time.Since(device.GetDateTime("last_seen").Time()) < deviceSeenInterval {
+		return nil
+	}
+
+	device.Set("last_seen", types.NowDateTime())
+	return dao.SaveRecord(device)
+}
+
+// expireStaleDevices removes the devices that have not been seen
+// for longer than deviceExpiry.
+func expireStaleDevices(dao *daos.Dao) error {
+	cutoff, err := types.ParseDateTime(time.Now().Add(-deviceExpiry))
+	if err != nil {
+		return err
+	}
+
+	devices, err := dao.FindRecordsByFilter("devices", "last_seen<{:cutoff}", "", 0, 0, dbx.Params{"cutoff": cutoff.String()})
+	if err != nil {
+		return err
+	}
+
+	for _, device := range devices {
+		if err := dao.DeleteRecord(device); err != nil {
+			return err
+		}
+	}
+
+	if len(devices) != 0 {
+		log.Printf("Expired %d stale devices\n", len(devices))
+	}
+
+	return nil
+}
+
+func startExpiringDevices(app core.App) *cron.Cron {
+	scheduler := cron.New()
+	scheduler.MustAdd("expire_devices", "0 * * * *", func() {
+		if err := expireStaleDevices(app.Dao()); err != nil {
+			log.Println(err)
+		}
+	})
+	scheduler.Start()
+	return scheduler
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultLocale = "en"
+
+// localizedNotification contains the translated strings of a notification kind.
+// Title and Body may contain fmt verbs which are filled in by the caller.
+type localizedNotification struct {
+	Title   string
+	Body    string
+	Actions map[string]string // action type -> button text
+}
+
+// notificationCatalog contains the messages of each notification kind keyed by
+// locale and then by notification kind.
+var notificationCatalog = map[string]map[string]localizedNotification{
+	"en": {
+		"test_fcm": {
+			Title: "Test FCM",
+			Body:  "This is a test notification",
+		},
+		"incoming_call": {
+			Title: "Incoming Call",
+			Body:  "%s is inviting you to a call",
+			Actions: map[string]string{
+				"accept_call_action":  "Accept",
+				"decline_call_action": "Decline",
+			},
+		},
+
+		"community_reminder": {
+			Title: "%s",
+			Body:  "%s",
+		},
+		"chat_message": {
+			Title: "%s",
+			Body:  "%s",
+		},
+		"chat_messages": {
+			Title: "%s",
+			Body:  "%d new messages",
+		},
+		"chat_mention": {
+			Title: "%s mentioned you",
+			Body:  "%s",
+		},
+		"chat_request_sent": {
+			Title: "Chat Request",
+			Body:  "%s wants to chat with you",
+		},
+		"chat_request_accepted": {
+			Title: "Chat Request Accepted",
+			Body:  "%s accepted your chat request",
+		},
+		"chat_request_declined": {
+			Title: "Chat Request Declined",
+			Body:  "%s declined your chat request",
+		},
+		"chat_request_withdrawn": {
+			Title: "Chat Request Withdrawn",
+			Body:  "%s withdrew their chat request",
+		},
+		"call_member_removed": {
+			Title: "Call Ended",
+			Body:  "You were removed from the chat of this call",
+		},
+		"call_chat_deleted": {
+			Title: "Call Ended",
+			Body:  "The chat of this call was deleted",
+		},
+		"call_calls_disabled": {
+			Title: "Call Ended",
+			Body:  "Calls are no longer allowed in the chat of this call",
+		},
+	},
+	"fil": {
+		"test_fcm": {
+			Title: "Test FCM",
+			Body:  "Ito ay isang pansubok na notification",
+		},
+		"incoming_call": {
+			Title: "Papasok na Tawag",
+			Body:  "Iniimbitahan ka ni %s sa isang tawag",
+			Actions: map[string]string{
+				"accept_call_action":  "Sagutin",
+				"decline_call_action": "Tanggihan",
+			},
+		},
+
+		"community_reminder": {
+			Title: "%s",
+			Body:  "%s",
+		},
+		"chat_message": {
+			Title: "%s",
+			Body:  "%s",
+		},
+		"chat_messages": {
+			Title: "%s",
+			Body:  "%d bagong mensahe",
+		},
+		"chat_mention": {
+			Title: "Binanggit ka ni %s",
+			Body:  "%s",
+		},
+		"chat_request_sent": {
+			Title: "Kahilingang Makipag-chat",
+			Body:  "Gustong makipag-chat sa iyo ni %s",
+		},
+		"chat_request_accepted": {
+			Title: "Tinanggap ang Kahilingan",
+			Body:  "Tinanggap ni %s ang iyong kahilingang makipag-chat",
+		},
+		"chat_request_declined": {
+			Title: "Tinanggihan ang Kahilingan",
+			Body:  "Tinanggihan ni %s ang iyong kahilingang makipag-chat",
+		},
+		"chat_request_withdrawn": {
+			Title: "Binawi ang Kahilingan",
+			Body:  "Binawi ni %s ang kanyang kahilingang makipag-chat",
+		},
+		"call_member_removed": {
+			Title: "Natapos ang Tawag",
+			Body:  "Inalis ka sa chat ng tawag na ito",
+		},
+		"call_chat_deleted": {
+			Title: "Natapos ang Tawag",
+			Body:  "Binura ang chat ng tawag na ito",
+		},
+		"call_calls_disabled": {
+			Title: "Natapos ang Tawag",
+			Body:  "Hindi na pinapayagan ang mga tawag sa chat ng tawag na ito",
+		},
+	},
+}
+
+// normalizeLocale converts locales such as "fil-PH" or "en_US" into the
+// language keys used by the catalog. Unsupported locales fall back to the
+// default locale.
+func normalizeLocale(locale string) string {
+	locale = strings.ToLower(strings.TrimSpace(locale))
+	if _, ok := notificationCatalog[locale]; ok {
+		return locale
+	}
+
+	if lang, _, found := strings.Cut(strings.ReplaceAll(locale, "_", "-"), "-"); found {
+		if _, ok := notificationCatalog[lang]; ok {
+			return lang
+		}
+	}
+
+	return defaultLocale
+}
+
+// localizeNotification returns the messages of the notification kind in the
+// given locale, falling back to the default locale for missing entries.
+func localizeNotification(locale string, kind string) localizedNotification {
+	if msg, ok := notificationCatalog[normalizeLocale(locale)][kind]; ok {
+		return msg
+	}
+	return notificationCatalog[defaultLocale][kind]
+}
+
+// Format returns the title and body with the provided arguments applied to them.
+func (l localizedNotification) Format(titleArgs []any, bodyArgs []any) (title string, body string) {
+	title = l.Title
+	if len(titleArgs) != 0 {
+		title = fmt.Sprintf(l.Title, titleArgs...)
+	}
+
+	body = l.Body
+	if len(bodyArgs) != 0 {
+		body = fmt.Sprintf(l.Body, bodyArgs...)
+	}
+	return
+}
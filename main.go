@@ -22,8 +22,11 @@ import (
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/plugins/migratecmd"
 	"golang.org/x/exp/slices"
 	"google.golang.org/api/option"
+
+	_ "github.com/nedpals/chumspace-backend/migrations"
 )
 
 func initializeFirebase() *firebase.App {
@@ -67,35 +70,31 @@ func makeChatIdentifier(fromChatType string, chatId string) string {
 	return fromChatType + ":" + chatId
 }
 
-func makeChatIdentifierRecord(r *models.Record) string {
-	fromChatType := "ds"
-	if r.Collection().Name == "chat_list_parent" {
-		fromChatType = "parent"
-	} else if r.Collection().Name == "chat_list_gc" {
-		fromChatType = "community"
-	}
-
-	return makeChatIdentifier(fromChatType, r.Id)
+func makeRoomNotificationTag(roomId string) string {
+	return "room:" + roomId
 }
 
-var validFromChatTypes = []string{"ds", "parent", "community"}
+// makeIncomingCallDedupeKey returns the dedupe key which prevents the
+// invitees of a call in the chat from being notified twice.
+func makeIncomingCallDedupeKey(fromChat string) string {
+	return incomingCallNotification.Name + ":" + fromChat
+}
 
-func decodeCallDetailsParams(c echo.Context) (fromChatType string, chatId string, err error) {
-	fromChatType = c.QueryParam("from_chat_type") // ds or parent
+func decodeCallDetailsParams(c echo.Context) (kind *ChatKind, chatId string, err error) {
+	fromChatType := c.QueryParam("from_chat_type") // ds, parent or community
 	if len(fromChatType) == 0 {
 		// from_room_type for legacy
 		fromChatType = c.QueryParam("from_room_type")
 	}
 
-	if fromChatType == "chum" {
-		fromChatType = "ds"
+	if len(fromChatType) == 0 {
+		err = apis.NewBadRequestError("from_chat_type is required", nil)
+		return
 	}
 
-	if !slices.Contains(validFromChatTypes, fromChatType) {
+	kind, err = findChatKind(fromChatType)
+	if err != nil {
 		err = apis.NewBadRequestError("invalid room type", nil)
-		if len(fromChatType) == 0 {
-			err = apis.NewBadRequestError("from_chat_type is required", nil)
-		}
 		return
 	}
 
@@ -111,6 +110,16 @@ func decodeCallDetailsParams(c echo.Context) (fromChatType string, chatId string
 func main() {
 	app := pocketbase.New()
 
+	// schema changes made in the admin UI are written as migrations
+	// only while developing with "go run"
+	isGoRun := strings.HasPrefix(os.Args[0], os.TempDir())
+	migratecmd.MustRegister(app, app.RootCmd, migratecmd.Config{
+		Automigrate: isGoRun,
+	})
+
+	// local dataset for exercising the chat and call routes
+	app.RootCmd.AddCommand(newSeedCommand(app))
+
 	// serves static files from the provided public dir (if exists)
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		e.Router.Use(apis.ActivityLogger(e.App))
@@ -118,15 +127,77 @@ func main() {
 		// notification scheduler
 		notifScheduler, monitorNotifications := startSchedulingNotifications()
 
-		// firebase
-		firebaseApp := initializeFirebase()
-		messagingClient, err := firebaseApp.Messaging(context.Background())
-		if err != nil {
-			return err
+		// push transports
+		if os.Getenv("PUSH_TRANSPORT") == "memory" {
+			log.Println("PUSH_TRANSPORT is set to memory. Notifications will only be recorded.")
+
+			recorder := NewRecordingTransport()
+			notifScheduler.SetTransport(transportFCM, recorder)
+			notifScheduler.SetTransport(transportAPNSVoIP, recorder)
+			notifScheduler.SetTransport(transportUnifiedPush, recorder)
+		} else {
+			// firebase
+			firebaseApp := initializeFirebase()
+			messagingClient, err := firebaseApp.Messaging(context.Background())
+			if err != nil {
+				return err
+			}
+
+			notifScheduler.SetTransport(transportFCM, messagingClient)
+
+			// apns (for VoIP pushes)
+			apnsClient, err := initializeAPNS()
+			if err != nil {
+				return err
+			} else if apnsClient == nil {
+				log.Println("APNS_AUTH_KEY is not set. VoIP pushes will not be sent.")
+			} else {
+				notifScheduler.SetTransport(transportAPNSVoIP, apnsClient)
+			}
+
+			// unifiedpush (for devices without google play services)
+			notifScheduler.SetTransport(transportUnifiedPush, NewUnifiedPushTransport())
 		}
 
-		// set the messaging client of the notification scheduler
-		notifScheduler.MessagingClient = messagingClient
+		// send the notifications that were pending on the last shutdown
+		if err := restorePendingNotifications(app.Dao(), notifScheduler); err != nil {
+			log.Println(err)
+		}
+
+		// flush the due notifications and keep the pending ones on shutdown
+		app.OnTerminate().Add(func(te *core.TerminateEvent) error {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+
+			pending := notifScheduler.Shutdown(ctx)
+			if err := storePendingNotifications(app.Dao(), pending); err != nil {
+				log.Printf("Error storing %d pending notifications: %v\n", len(pending), err)
+			}
+			return nil
+		})
+
+		// keep the notifications that failed after all of their attempts
+		notifScheduler.OnDeadLetter = func(notif *ScheduledNotification, lastErr error) {
+			if err := storeDeadLetter(app.Dao(), notif, lastErr); err != nil {
+				log.Println(err)
+			}
+		}
+
+		// failed notifications can be re-sent from their dead letters
+		notifScheduler.LoadDeadLetter = func(id string) *ScheduledNotification {
+			notif, err := findDeadLetter(app.Dao(), id)
+			if err != nil {
+				return nil
+			}
+			return notif
+		}
+
+		// remove the tokens that FCM or APNs reported as invalid
+		notifScheduler.OnInvalidToken = func(token string) {
+			if err := removePushToken(app.Dao(), token); err != nil {
+				log.Println(err)
+			}
+		}
 
 		// get the livekit host
 		lkHost, lkHostExists := os.LookupEnv("LIVEKIT_SERVER_URL")
@@ -147,6 +218,32 @@ func main() {
 
 		lkRoomClient := lksdk.NewRoomServiceClient(lkHost, lkApiKey, lkApiSecret)
 
+		// notification queue inspection for admins
+		bindNotificationAdminApi(e, notifScheduler)
+
+		// delivery and open receipts
+		bindReceiptApi(app, e, notifScheduler)
+
+		// devices
+		bindDeviceApi(app, e)
+		startExpiringDevices(app)
+
+		// new chat messages
+		bindChatMessageNotifications(app, notifScheduler)
+		bindReadStateApi(app, e)
+		bindReadStateCleanup(app)
+
+		// chat requests of ds chats
+		bindChatRequestApi(app, e, notifScheduler)
+
+		// keep the call rooms in sync with the members of their chats
+		bindCallRoomSync(app, notifScheduler, lkRoomClient)
+
+		// recurring reminders of communities
+		if err := bindCommunityReminders(app, notifScheduler); err != nil {
+			log.Println(err)
+		}
+
 		e.Router.Add("POST", "/api/test_fcm", func(c echo.Context) error {
 			// get the token from query params
 			token := c.QueryParam("token")
@@ -159,13 +256,14 @@ func main() {
 
 			// construct the message
 			ttl := time.Duration(10) * time.Second
+			title, body := localizeNotification(apis.RequestInfo(c).AuthRecord.GetString("locale"), "test_fcm").Format(nil, nil)
 			message := &messaging.Message{
 				Data: map[string]string{
 					"type": "test_fcm",
 				},
 				Notification: &messaging.Notification{
-					Title: "Test FCM",
-					Body:  "This is a test notification",
+					Title: title,
+					Body:  body,
 				},
 				Android: &messaging.AndroidConfig{
 					TTL: &ttl,
@@ -173,20 +271,16 @@ func main() {
 				Token: token,
 			}
 
-			if isDev {
-				_, err := notifScheduler.MessagingClient.Send(context.Background(), message)
-				if err != nil {
-					return fmt.Errorf("error sending notification: %v", err)
-				}
+			var err error
+			transport := notifScheduler.Transport(transportFCM)
+			if client, isFCM := transport.(*messaging.Client); isFCM && !isDev {
+				_, err = client.SendDryRun(context.Background(), message)
 			} else {
-				_, err := notifScheduler.MessagingClient.SendDryRun(context.Background(), message)
-				if err != nil {
-					return fmt.Errorf("error sending notification: %v", err)
-				}
+				_, err = transport.Send(context.Background(), message)
 			}
 
 			if err != nil {
-				return apis.NewBadRequestError(err.Error(), nil)
+				return apis.NewBadRequestError(fmt.Sprintf("error sending notification: %v", err), nil)
 			}
 
 			return c.JSON(http.StatusOK, map[string]string{
@@ -196,7 +290,7 @@ func main() {
 
 		e.Router.Add("POST", "/api/join_call", func(c echo.Context) error {
 			// get the room type and chat id
-			fromChatType, chatId, err := decodeCallDetailsParams(c)
+			chatKind, chatId, err := decodeCallDetailsParams(c)
 			if err != nil {
 				return err
 			}
@@ -205,20 +299,14 @@ func main() {
 			callType := c.QueryParamDefault("type", "audio")
 
 			// get the chat info
-			chatListCollectionName := "chat_list_" + fromChatType
-			if fromChatType == "community" {
-				chatListCollectionName = "chat_list_gc"
-			}
-
-			chat, err := app.Dao().FindRecordById(chatListCollectionName, chatId)
+			chat, err := chatKind.FindChat(app.Dao(), chatId)
 			if err != nil {
 				return err
 			}
 
-			if fromChatType == "community" {
-				apis.EnrichRecord(c, app.Dao(), chat, "community", "parents")
-			} else {
-				apis.EnrichRecord(c, app.Dao(), chat, "chatRequestTo", "chatRequestBy")
+			// e.g. ds chats whose chat request has not been accepted
+			if !chatKind.AllowsCalls(chat) {
+				return apis.NewForbiddenError("calls are not allowed in this chat", nil)
 			}
 
 			// get the user
@@ -249,7 +337,7 @@ func main() {
 
 			// get the room if it already exists
 			roomRecord, err := app.Dao().FindFirstRecordByFilter(roomCollection.Id, "from_chat={:from_chat}", dbx.Params{
-				"from_chat": makeChatIdentifier(fromChatType, chat.Id),
+				"from_chat": chatKind.Identifier(chat.Id),
 			})
 			if err != nil {
 				hosts := []string{user.Id}
@@ -257,29 +345,15 @@ func main() {
 				// create the room if it doesn't exist
 				roomRecord = models.NewRecord(roomCollection)
 
-				if fromChatType == "community" {
-					expandedCommunity := chat.ExpandedOne("community")
-
-					// include community account in hosts
-					hosts = append(hosts, expandedCommunity.GetString("users"))
-
-					expandedParents := chat.ExpandedAll("parents")
-					invitedParticipants := make([]string, 1+len(expandedParents)) // community user + parents
-
-					invitedParticipants[0] = expandedCommunity.GetString("users")
-					for idx, parent := range expandedParents {
-						invitedParticipants[idx+1] = parent.GetString("users")
+				// include the hosts of the chat (e.g. the community account)
+				for _, hostId := range chatKind.HostIds(app.Dao(), chat) {
+					if !slices.Contains(hosts, hostId) {
+						hosts = append(hosts, hostId)
 					}
-
-					roomRecord.Set("invited_participants", invitedParticipants)
-				} else {
-					roomRecord.Set("invited_participants", []string{
-						chat.ExpandedOne("chatRequestTo").GetString("users"),
-						chat.ExpandedOne("chatRequestBy").GetString("users"),
-					})
 				}
 
-				roomRecord.Set("from_chat", makeChatIdentifier(fromChatType, chat.Id))
+				roomRecord.Set("invited_participants", chatKind.MemberIds(app.Dao(), chat))
+				roomRecord.Set("from_chat", chatKind.Identifier(chat.Id))
 				roomRecord.Set("hosts", hosts)
 				roomRecord.Set("participants", []string{})
 			}
@@ -291,6 +365,13 @@ func main() {
 				return apis.NewForbiddenError("forbidden to join this room", nil)
 			}
 
+			// starting a call rings the other members so it is limited per chat
+			if !isRoomExisting {
+				if allowed, retryAfter := callRateLimiter.Allow(user.Id + ":" + roomRecord.GetString("from_chat")); !allowed {
+					return newRateLimitError(c, "Too many call attempts. Try again later.", retryAfter)
+				}
+			}
+
 			// add the user to the room if they are not already in it
 			participants := roomRecord.GetStringSlice("participants")
 			if !slices.Contains(participants, user.Id) {
@@ -326,8 +407,7 @@ func main() {
 
 			// notify other invited participants
 			if !isRoomExisting {
-				inviteeJson, _ := json.Marshal(user.PublicExport())
-				tokens := []string{}
+				recipients := []*models.Record{}
 
 				if err := apis.EnrichRecord(c, app.Dao(), roomRecord, "invited_participants"); err == nil {
 					participants := roomRecord.GetStringSlice("participants")
@@ -340,14 +420,11 @@ func main() {
 						}
 
 						fmt.Printf("[call_room:%s] Notifying %s (%s)\n", roomRecord.Id, participant.GetString("name"), participant.Id)
-						participantTokens := participant.GetStringSlice("fcm_tokens")
-						tokens = append(tokens, participantTokens...)
+						recipients = append(recipients, participant)
 					}
 				}
 
-				if len(tokens) != 0 {
-					// construct the message
-					ttl := time.Duration(5) * time.Minute
+				if targets := findPushTargets(app.Dao(), recipients); len(targets) != 0 {
 					imageUrl := "" // picture of user with no avatar
 					if avatar := user.GetString("avatar"); len(avatar) != 0 {
 						gotImageUrl, err := url.JoinPath(app.Settings().Meta.AppUrl, "api/files/users", user.Id, avatar)
@@ -356,54 +433,16 @@ func main() {
 						}
 					}
 
-					// separate notification data to be put into data payload
-					// as a JSON string to be parsed by the app
-					//
-					// this is to avoid FCM from automatically showing the notification
-					notifJson, _ := json.Marshal(map[string]any{
-						"id":         1, // 1 for incoming call
-						"type":       "incoming_call",
-						"title":      "Incoming Call",
-						"body":       participantName + " is inviting you to a call",
-						"image_url":  imageUrl,
-						"importance": "max",
-						"priority":   "high",
-						"actions": []map[string]any{
-							{
-								"type":                 "accept_call_action",
-								"text":                 "Accept",
-								"shows_user_interface": true,
-							},
-							{
-								"type":                 "decline_call_action",
-								"text":                 "Decline",
-								"shows_user_interface": false,
-							},
-						},
-						"details": map[string]any{
-							"full_screen_intent": true,
-						},
-					})
-
-					notifScheduler.AddNotification(&ScheduledNotification{
-						MulticastMessage: &messaging.MulticastMessage{
-							Data: map[string]string{
-								"type":           "incoming_call",
-								"notification":   string(notifJson),
-								"call_type":      callType,
-								"invitee":        string(inviteeJson),
-								"chat_id":        chat.Id,
-								"from_chat_type": fromChatType,
-								"image_url":      imageUrl,
-							},
-							Android: &messaging.AndroidConfig{
-								Priority: "high",
-								TTL:      &ttl,
-							},
-							Tokens: tokens,
-						},
-						ScheduledTime: time.Now().Add(2 * time.Second),
-					})
+					// tokens are batched by locale and platform so that each participant
+					// receives the notification in their language and each device
+					// receives the payload that suits it
+					scheduleNotification(notifScheduler, IncomingCallParams{
+						Caller:         user,
+						CallerImageUrl: imageUrl,
+						CallType:       callType,
+						ChatId:         chat.Id,
+						FromChatType:   chatKind.Name,
+					}, targets, time.Now().Add(2*time.Second), makeIncomingCallDedupeKey(roomRecord.GetString("from_chat")), makeRoomNotificationTag(roomRecord.Id))
 				}
 			}
 
@@ -416,7 +455,7 @@ func main() {
 
 		e.Router.Add("GET", "/api/room_participants", func(c echo.Context) error {
 			// get the room type and chat id
-			fromChatType, chatId, err := decodeCallDetailsParams(c)
+			chatKind, chatId, err := decodeCallDetailsParams(c)
 			if err != nil {
 				return err
 			}
@@ -425,7 +464,7 @@ func main() {
 			user := apis.RequestInfo(c).AuthRecord
 			room, err := app.Dao().FindFirstRecordByFilter("call_rooms", "from_chat={:from_chat} && invited_participants~{:user}",
 				dbx.Params{
-					"from_chat": makeChatIdentifier(fromChatType, chatId),
+					"from_chat": chatKind.Identifier(chatId),
 					"user":      user.Id,
 				})
 			if err != nil {
@@ -491,7 +530,7 @@ func main() {
 
 		// this route is for the invited participants to respond the call
 		e.Router.Add("POST", "/api/room_data", func(c echo.Context) error {
-			fromChatType, chatId, err := decodeCallDetailsParams(c)
+			chatKind, chatId, err := decodeCallDetailsParams(c)
 			if err != nil {
 				return err
 			}
@@ -499,7 +538,7 @@ func main() {
 			user := apis.RequestInfo(c).AuthRecord
 			room, err := app.Dao().FindFirstRecordByFilter("call_rooms", "from_chat={:from_chat} && invited_participants~{:user}",
 				dbx.Params{
-					"from_chat": makeChatIdentifier(fromChatType, chatId),
+					"from_chat": chatKind.Identifier(chatId),
 					"user":      user.Id,
 				})
 			if err != nil {
@@ -550,7 +589,7 @@ func main() {
 
 		e.Router.Add("POST", "/api/leave_call", func(c echo.Context) error {
 			// get the chat info
-			fromChatType, chatId, err := decodeCallDetailsParams(c)
+			chatKind, chatId, err := decodeCallDetailsParams(c)
 			if err != nil {
 				return err
 			}
@@ -558,14 +597,14 @@ func main() {
 			fromError := c.QueryParam("from_error") == "1"
 			user := apis.RequestInfo(c).AuthRecord
 			room, err := app.Dao().FindFirstRecordByFilter("call_rooms", "from_chat={:from_chat} && participants~{:user}", dbx.Params{
-				"from_chat": makeChatIdentifier(fromChatType, chatId),
+				"from_chat": chatKind.Identifier(chatId),
 				"user":      user.Id,
 			})
 			if err == nil {
 				participants := room.GetStringSlice("participants")
 				// if the user is the last participant, remove the room
 				if len(participants)-1 <= 0 {
-					app.Dao().DeleteRecord(room)
+					endCallRoom(app.Dao(), notifScheduler, room)
 				} else {
 					participantIdx := slices.Index(participants, user.Id)
 					participants = slices.Delete(participants, participantIdx, participantIdx+1)
@@ -588,55 +627,6 @@ func main() {
 		return nil
 	})
 
-	app.OnRecordAfterUpdateRequest().Add(func(e *core.RecordUpdateEvent) error {
-		if e.Collection.Name != "chat_list_ds" && e.Collection.Name != "chat_list_parent" && e.Collection.Name != "chat_list_gc" {
-			return nil
-		}
-
-		// check if chat list is present in call rooms
-		idToLook := makeChatIdentifierRecord(e.Record)
-		room, err := app.Dao().FindFirstRecordByFilter("call_rooms", "from_chat={:from_chat}", dbx.Params{"from_chat": idToLook})
-		if err != nil {
-			return nil
-		}
-
-		// if chat list is present, update the invited participants
-		invitedParticipants := room.GetStringSlice("invited_participants")
-
-		if e.Collection.Name == "chat_list_parent" {
-			if err := apis.EnrichRecord(e.HttpContext, app.Dao(), e.Record, "parents"); err != nil {
-				log.Println(err)
-				return nil
-			}
-
-			expandedParents := e.Record.ExpandedAll("parents")
-			parentUsersId := make([]string, len(expandedParents))
-			for idx, parent := range expandedParents {
-				parentUsersId[idx] = parent.GetString("users")
-			}
-
-			invitedParticipants = parentUsersId
-		} else {
-			if err := apis.EnrichRecord(e.HttpContext, app.Dao(), e.Record, "chatRequestTo", "chatRequestBy"); err != nil {
-				log.Println(err)
-				return nil
-			}
-
-			invitedParticipants = []string{
-				e.Record.ExpandedOne("chatRequestTo").GetString("users"),
-				e.Record.ExpandedOne("chatRequestBy").GetString("users"),
-			}
-		}
-
-		room.Set("invited_participants", invitedParticipants)
-		if err := app.Dao().SaveRecord(room); err != nil {
-			// do not return error or it will cause the update to fail
-			log.Println(err)
-		}
-
-		return nil
-	})
-
 	if err := app.Start(); err != nil {
 		log.Fatalln(err)
 	}
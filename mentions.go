@@ -0,0 +1,93 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pocketbase/pocketbase/models"
+	"golang.org/x/exp/slices"
+)
+
+// types of the mentions in a message
+const (
+	mentionTypeUser     = "user"
+	mentionTypeEveryone = "everyone"
+	mentionTypeHosts    = "hosts"
+)
+
+// chatMention is a mention in the content of a message. Start and End
+// are the character offsets of the mention (including the "@").
+type chatMention struct {
+	Type  string `json:"type"`
+	User  string `json:"user,omitempty"`
+	Text  string `json:"text"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+var mentionPattern = regexp.MustCompile(`(?:^|\s)(@[\pL\pN_.-]+)`)
+
+// parseMentions returns the mentions of the members (keyed by username) in the
+// content. @everyone is only a mention if the sender is allowed to use it.
+func parseMentions(content string, members map[string]*models.Record, canMentionEveryone bool) []chatMention {
+	mentions := []chatMention{}
+	for _, match := range mentionPattern.FindAllStringSubmatchIndex(content, -1) {
+		start, end := match[2], match[3]
+		text := content[start:end]
+		name := strings.TrimRight(text[1:], ".-")
+		end = start + 1 + len(name)
+
+		mention := chatMention{
+			Text:  content[start:end],
+			Start: utf8.RuneCountInString(content[:start]),
+			End:   utf8.RuneCountInString(content[:end]),
+		}
+
+		switch strings.ToLower(name) {
+		case "everyone":
+			if !canMentionEveryone {
+				continue
+			}
+			mention.Type = mentionTypeEveryone
+		case "hosts":
+			mention.Type = mentionTypeHosts
+		default:
+			member, isMember := members[strings.ToLower(name)]
+			if !isMember {
+				continue
+			}
+			mention.Type = mentionTypeUser
+			mention.User = member.Id
+		}
+
+		mentions = append(mentions, mention)
+	}
+
+	return mentions
+}
+
+// mentionedUserIds returns the ids of the members mentioned by the mentions.
+func mentionedUserIds(mentions []chatMention, memberIds []string, hostIds []string) []string {
+	userIds := []string{}
+	add := func(ids ...string) {
+		for _, id := range ids {
+			if slices.Contains(memberIds, id) && !slices.Contains(userIds, id) {
+				userIds = append(userIds, id)
+			}
+		}
+	}
+
+	for _, mention := range mentions {
+		switch mention.Type {
+		case mentionTypeUser:
+			add(mention.User)
+		case mentionTypeEveryone:
+			add(memberIds...)
+		case mentionTypeHosts:
+			add(hostIds...)
+		}
+	}
+
+	return userIds
+}
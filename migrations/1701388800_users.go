@@ -0,0 +1,106 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// userFields are the fields added to the default users collection:
+//
+//   - label: the type of the profile of the user (users_<label>)
+//   - locale and timezone: the preferences used for notifications
+//   - fcm_tokens, web_push_tokens and apns_voip_tokens: the legacy push
+//     tokens of users who have not registered a device yet
+var userFields = []string{"label", "locale", "timezone", "fcm_tokens", "web_push_tokens", "apns_voip_tokens"}
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		users, err := dao.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		// existing instances may already have some of the fields
+		addMissingFields(users,
+			selectField("label", false, "parent", "community"),
+			textField("locale", false),
+			textField("timezone", false),
+			jsonField("fcm_tokens"),
+			jsonField("web_push_tokens"),
+			jsonField("apns_voip_tokens"),
+		)
+
+		// the label decides the profile of a user so it can not be changed by the user
+		users.UpdateRule = rule("id = @request.auth.id && @request.data.label:isset = false")
+
+		if err := dao.SaveCollection(users); err != nil {
+			return err
+		}
+
+		// the profile of a user can be viewed by any signed in user
+		// but only be changed by its user
+		profileRules := func(collection *models.Collection) *models.Collection {
+			collection.ListRule = rule("@request.auth.id != ''")
+			collection.ViewRule = rule("@request.auth.id != ''")
+			collection.CreateRule = rule("@request.auth.id != '' && @request.data.users = @request.auth.id")
+			collection.UpdateRule = rule("users = @request.auth.id && (@request.data.users:isset = false || @request.data.users = @request.auth.id)")
+			collection.DeleteRule = rule("users = @request.auth.id")
+			return collection
+		}
+
+		usersParent := profileRules(&models.Collection{
+			Name: "users_parent",
+			Type: models.CollectionTypeBase,
+			Schema: schema.NewSchema(
+				relationField("users", "users", true, 1, true),
+				textField("first_name", true),
+				textField("middle_name", false),
+				textField("last_name", true),
+				avatarField("avatar"),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_users_parent_users` ON `users_parent` (`users`)",
+			},
+		})
+
+		usersCommunity := profileRules(&models.Collection{
+			Name: "users_community",
+			Type: models.CollectionTypeBase,
+			Schema: schema.NewSchema(
+				relationField("users", "users", true, 1, true),
+				textField("name", true),
+				avatarField("avatar"),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_users_community_users` ON `users_community` (`users`)",
+			},
+		})
+
+		return saveCollections(db, usersParent, usersCommunity)
+	}, func(db dbx.Builder) error {
+		if err := deleteCollections(db, "users_community", "users_parent"); err != nil {
+			return err
+		}
+
+		dao := daos.New(db)
+		users, err := dao.FindCollectionByNameOrId("users")
+		if err != nil {
+			return err
+		}
+
+		users.UpdateRule = rule("id = @request.auth.id")
+		for _, name := range userFields {
+			if field := users.Schema.GetFieldByName(name); field != nil {
+				users.Schema.RemoveField(field.Id)
+			}
+		}
+
+		return dao.SaveCollection(users)
+	})
+}
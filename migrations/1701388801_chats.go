@@ -0,0 +1,178 @@
+package migrations
+
+import (
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// chat member rules of each chat list collection
+const (
+	chatListDsMemberRule        = "chatRequestTo.users = @request.auth.id || chatRequestBy.users = @request.auth.id"
+	chatListParentMemberRule    = "parents.users ?= @request.auth.id"
+	chatListCommunityMemberRule = "community.users = @request.auth.id || parents.users ?= @request.auth.id"
+)
+
+// messageMemberRule returns the rule of the members of the chat of a message.
+func messageMemberRule(chatMemberRule string) string {
+	conditions := strings.Split(chatMemberRule, " || ")
+	for idx, condition := range conditions {
+		conditions[idx] = "chat." + condition
+	}
+	return "(" + strings.Join(conditions, " || ") + ")"
+}
+
+// messagesCollection returns the collection of the messages of the chat list.
+// The mentions of a message are only set by the server.
+func messagesCollection(name string, chatListCollection string, chatMemberRule string) *models.Collection {
+	memberRule := messageMemberRule(chatMemberRule)
+	return &models.Collection{
+		Name:       name,
+		Type:       models.CollectionTypeBase,
+		ListRule:   rule(memberRule),
+		ViewRule:   rule(memberRule),
+		CreateRule: rule(memberRule + " && @request.data.sender = @request.auth.id && @request.data.mentions:isset = false"),
+		UpdateRule: rule("sender = @request.auth.id && (@request.data.sender:isset = false || @request.data.sender = @request.auth.id) && @request.data.mentions:isset = false"),
+		DeleteRule: rule("sender = @request.auth.id"),
+		Schema: schema.NewSchema(
+			relationField("chat", chatListCollection, true, 1, true),
+			relationField("sender", "users", true, 1, false),
+			textField("content", false),
+			jsonField("mentions"),
+		),
+		Indexes: types.JsonArray[string]{
+			"CREATE INDEX `idx_" + name + "_chat` ON `" + name + "` (`chat`, `created`)",
+		},
+	}
+}
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		// chats between two users who sent and received a chat request.
+		// requests are sent and answered through the chat request routes
+		chatListDs := &models.Collection{
+			Name:       "chat_list_ds",
+			Type:       models.CollectionTypeBase,
+			ListRule:   rule(chatListDsMemberRule),
+			ViewRule:   rule(chatListDsMemberRule),
+			DeleteRule: rule(chatListDsMemberRule),
+			Schema: schema.NewSchema(
+				relationField("chatRequestBy", "users_parent", true, 1, true),
+				relationField("chatRequestTo", "users_parent", true, 1, true),
+				selectField("status", false, "pending", "accepted", "declined", "withdrawn"),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE INDEX `idx_chat_list_ds_request` ON `chat_list_ds` (`chatRequestBy`, `chatRequestTo`)",
+			},
+		}
+
+		chatListParent := &models.Collection{
+			Name:       "chat_list_parent",
+			Type:       models.CollectionTypeBase,
+			ListRule:   rule(chatListParentMemberRule),
+			ViewRule:   rule(chatListParentMemberRule),
+			CreateRule: rule("@request.auth.label = 'parent'"),
+			UpdateRule: rule(chatListParentMemberRule),
+			DeleteRule: rule(chatListParentMemberRule),
+			Schema: schema.NewSchema(
+				relationField("parents", "users_parent", true, 0, false),
+			),
+		}
+
+		// community chats are managed by the community account
+		chatListGc := &models.Collection{
+			Name:       "chat_list_gc",
+			Type:       models.CollectionTypeBase,
+			ListRule:   rule(chatListCommunityMemberRule),
+			ViewRule:   rule(chatListCommunityMemberRule),
+			CreateRule: rule("@request.auth.label = 'community' && @request.data.community.users = @request.auth.id"),
+			UpdateRule: rule("community.users = @request.auth.id && (@request.data.community:isset = false || @request.data.community.users = @request.auth.id)"),
+			DeleteRule: rule("community.users = @request.auth.id"),
+			Schema: schema.NewSchema(
+				relationField("community", "users_community", true, 1, true),
+				relationField("parents", "users_parent", false, 0, false),
+			),
+		}
+
+		// the active calls of the chats are managed by the call routes
+		callRooms := &models.Collection{
+			Name:     "call_rooms",
+			Type:     models.CollectionTypeBase,
+			ListRule: rule("invited_participants.id ?= @request.auth.id"),
+			ViewRule: rule("invited_participants.id ?= @request.auth.id"),
+			Schema: schema.NewSchema(
+				textField("from_chat", true),
+				relationField("invited_participants", "users", false, 0, false),
+				relationField("participants", "users", false, 0, false),
+				relationField("hosts", "users", false, 0, false),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_call_rooms_from_chat` ON `call_rooms` (`from_chat`)",
+			},
+		}
+
+		chatMutes := &models.Collection{
+			Name:       "chat_mutes",
+			Type:       models.CollectionTypeBase,
+			ListRule:   rule("user = @request.auth.id"),
+			ViewRule:   rule("user = @request.auth.id"),
+			CreateRule: rule("@request.data.user = @request.auth.id"),
+			UpdateRule: rule("user = @request.auth.id && (@request.data.user:isset = false || @request.data.user = @request.auth.id)"),
+			DeleteRule: rule("user = @request.auth.id"),
+			Schema: schema.NewSchema(
+				relationField("user", "users", true, 1, true),
+				textField("chat", true),
+				dateField("until", false),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_chat_mutes_user_chat` ON `chat_mutes` (`user`, `chat`)",
+			},
+		}
+
+		// read states are updated by the server on new messages and the read route
+		chatReadStates := &models.Collection{
+			Name:     "chat_read_states",
+			Type:     models.CollectionTypeBase,
+			ListRule: rule("user = @request.auth.id"),
+			ViewRule: rule("user = @request.auth.id"),
+			Schema: schema.NewSchema(
+				relationField("user", "users", true, 1, true),
+				textField("chat", true),
+				numberField("unread"),
+				textField("last_read_message", false),
+				dateField("last_read_at", false),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_chat_read_states_user_chat` ON `chat_read_states` (`user`, `chat`)",
+			},
+		}
+
+		return saveCollections(db,
+			chatListDs,
+			chatListParent,
+			chatListGc,
+			messagesCollection("chat_messages_ds", "chat_list_ds", chatListDsMemberRule),
+			messagesCollection("chat_messages_parent", "chat_list_parent", chatListParentMemberRule),
+			messagesCollection("chat_messages_gc", "chat_list_gc", chatListCommunityMemberRule),
+			callRooms,
+			chatMutes,
+			chatReadStates,
+		)
+	}, func(db dbx.Builder) error {
+		return deleteCollections(db,
+			"chat_read_states",
+			"chat_mutes",
+			"call_rooms",
+			"chat_messages_gc",
+			"chat_messages_parent",
+			"chat_messages_ds",
+			"chat_list_gc",
+			"chat_list_parent",
+			"chat_list_ds",
+		)
+	})
+}
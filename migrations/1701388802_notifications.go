@@ -0,0 +1,123 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		// devices are registered through the device routes
+		devices := &models.Collection{
+			Name:     "devices",
+			Type:     models.CollectionTypeBase,
+			ListRule: rule("user = @request.auth.id"),
+			ViewRule: rule("user = @request.auth.id"),
+			Schema: schema.NewSchema(
+				relationField("user", "users", true, 1, true),
+				textField("token", true),
+				selectField("platform", false, "android", "ios", "web"),
+				selectField("transport", false, "fcm", "unifiedpush"),
+				textField("voip_token", false),
+				textField("app_version", false),
+				textField("locale", false),
+				textField("timezone", false),
+				dateField("last_seen", false),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE UNIQUE INDEX `idx_devices_token` ON `devices` (`token`)",
+				"CREATE INDEX `idx_devices_user` ON `devices` (`user`)",
+				"CREATE INDEX `idx_devices_voip_token` ON `devices` (`voip_token`)",
+			},
+		}
+
+		notificationReceipts := &models.Collection{
+			Name: "notification_receipts",
+			Type: models.CollectionTypeBase,
+			Schema: schema.NewSchema(
+				textField("notification_id", true),
+				textField("kind", false),
+				relationField("user", "users", true, 1, true),
+				relationField("device", "devices", false, 1, false),
+				selectField("event", true, "delivered", "displayed", "action_taken"),
+				textField("action", false),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE INDEX `idx_notification_receipts_notification` ON `notification_receipts` (`notification_id`)",
+			},
+		}
+
+		notificationDeadLetters := &models.Collection{
+			Name: "notification_dead_letters",
+			Type: models.CollectionTypeBase,
+			Schema: schema.NewSchema(
+				textField("notification_id", true),
+				textField("kind", false),
+				jsonField("recipients"),
+				jsonField("tags"),
+				textField("transport", false),
+				numberField("attempts"),
+				jsonField("tokens"),
+				jsonField("message"),
+				textField("error", false),
+			),
+		}
+
+		// reminders are managed by the community account of the chat
+		notificationSchedules := &models.Collection{
+			Name:       "notification_schedules",
+			Type:       models.CollectionTypeBase,
+			ListRule:   rule("chat.community.users = @request.auth.id"),
+			ViewRule:   rule("chat.community.users = @request.auth.id"),
+			CreateRule: rule("@request.auth.label = 'community' && @request.data.chat.community.users = @request.auth.id"),
+			UpdateRule: rule("chat.community.users = @request.auth.id && (@request.data.chat:isset = false || @request.data.chat.community.users = @request.auth.id)"),
+			DeleteRule: rule("chat.community.users = @request.auth.id"),
+			Schema: schema.NewSchema(
+				relationField("chat", "chat_list_gc", true, 1, true),
+				textField("message", true),
+				textField("rule", true),
+				dateField("until", false),
+				boolField("paused"),
+			),
+		}
+
+		pendingNotifications := &models.Collection{
+			Name: "pending_notifications",
+			Type: models.CollectionTypeBase,
+			Schema: schema.NewSchema(
+				textField("notification_id", true),
+				textField("kind", false),
+				jsonField("recipients"),
+				jsonField("tags"),
+				textField("transport", false),
+				numberField("attempts"),
+				numberField("max_attempts"),
+				dateField("scheduled_time", false),
+				jsonField("message"),
+				jsonField("multicast_message"),
+			),
+			Indexes: types.JsonArray[string]{
+				"CREATE INDEX `idx_pending_notifications_scheduled_time` ON `pending_notifications` (`scheduled_time`)",
+			},
+		}
+
+		return saveCollections(db,
+			devices,
+			notificationReceipts,
+			notificationDeadLetters,
+			notificationSchedules,
+			pendingNotifications,
+		)
+	}, func(db dbx.Builder) error {
+		return deleteCollections(db,
+			"pending_notifications",
+			"notification_schedules",
+			"notification_dead_letters",
+			"notification_receipts",
+			"devices",
+		)
+	})
+}
@@ -0,0 +1,206 @@
+// Package migrations defines the collections used by the backend. The
+// migrations are registered with the app migrations of PocketBase so that
+// a fresh pb_data boots into a working backend.
+package migrations
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/dbutils"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// rule returns an API rule. Collections without a rule are only accessible to admins.
+func rule(expr string) *string {
+	return types.Pointer(expr)
+}
+
+func textField(name string, required bool) *schema.SchemaField {
+	return &schema.SchemaField{
+		Name:     name,
+		Type:     schema.FieldTypeText,
+		Required: required,
+		Options:  &schema.TextOptions{},
+	}
+}
+
+func numberField(name string) *schema.SchemaField {
+	return &schema.SchemaField{
+		Name:    name,
+		Type:    schema.FieldTypeNumber,
+		Options: &schema.NumberOptions{NoDecimal: true},
+	}
+}
+
+func boolField(name string) *schema.SchemaField {
+	return &schema.SchemaField{
+		Name:    name,
+		Type:    schema.FieldTypeBool,
+		Options: &schema.BoolOptions{},
+	}
+}
+
+func dateField(name string, required bool) *schema.SchemaField {
+	return &schema.SchemaField{
+		Name:     name,
+		Type:     schema.FieldTypeDate,
+		Required: required,
+		Options:  &schema.DateOptions{},
+	}
+}
+
+func jsonField(name string) *schema.SchemaField {
+	return &schema.SchemaField{
+		Name:    name,
+		Type:    schema.FieldTypeJson,
+		Options: &schema.JsonOptions{},
+	}
+}
+
+func selectField(name string, required bool, values ...string) *schema.SchemaField {
+	return &schema.SchemaField{
+		Name:     name,
+		Type:     schema.FieldTypeSelect,
+		Required: required,
+		Options: &schema.SelectOptions{
+			MaxSelect: 1,
+			Values:    values,
+		},
+	}
+}
+
+func avatarField(name string) *schema.SchemaField {
+	return &schema.SchemaField{
+		Name: name,
+		Type: schema.FieldTypeFile,
+		Options: &schema.FileOptions{
+			MaxSelect: 1,
+			MaxSize:   5242880,
+			MimeTypes: []string{"image/jpeg", "image/png", "image/webp", "image/gif"},
+			Thumbs:    []string{"100x100"},
+		},
+	}
+}
+
+// relationField returns a relation to the records of the collection with
+// the name. The name is resolved to the id of the collection when the
+// collection is saved. Relations with a maxSelect of 0 can have any number
+// of records.
+func relationField(name string, collectionName string, required bool, maxSelect int, cascadeDelete bool) *schema.SchemaField {
+	options := &schema.RelationOptions{
+		CollectionId:  collectionName,
+		CascadeDelete: cascadeDelete,
+	}
+
+	if maxSelect > 0 {
+		options.MaxSelect = types.Pointer(maxSelect)
+	}
+
+	return &schema.SchemaField{
+		Name:     name,
+		Type:     schema.FieldTypeRelation,
+		Required: required,
+		Options:  options,
+	}
+}
+
+// addMissingFields adds the fields which the collection does not have yet.
+// Existing fields are kept as they are.
+func addMissingFields(collection *models.Collection, fields ...*schema.SchemaField) {
+	for _, field := range fields {
+		if collection.Schema.GetFieldByName(field.Name) == nil {
+			collection.Schema.AddField(field)
+		}
+	}
+}
+
+// addMissingIndexes adds the indexes which the collection does not have yet.
+func addMissingIndexes(collection *models.Collection, indexes ...string) {
+	names := map[string]bool{}
+	for _, index := range collection.Indexes {
+		names[strings.ToLower(dbutils.ParseIndex(index).IndexName)] = true
+	}
+
+	for _, index := range indexes {
+		if !names[strings.ToLower(dbutils.ParseIndex(index).IndexName)] {
+			collection.Indexes = append(collection.Indexes, index)
+		}
+	}
+}
+
+// resolveRelations replaces the collection names of the relation fields
+// with the ids of the collections.
+func resolveRelations(dao *daos.Dao, collection *models.Collection) error {
+	for _, field := range collection.Schema.Fields() {
+		if field.Type != schema.FieldTypeRelation {
+			continue
+		}
+
+		options, ok := field.Options.(*schema.RelationOptions)
+		if !ok {
+			continue
+		}
+
+		related, err := dao.FindCollectionByNameOrId(options.CollectionId)
+		if err != nil {
+			return fmt.Errorf("failed to resolve the relation %s.%s: %w", collection.Name, field.Name, err)
+		}
+		options.CollectionId = related.Id
+	}
+	return nil
+}
+
+// saveCollections creates the collections in order. Instances which were set
+// up before the migrations may already have some of the collections, so those
+// are patched instead: their missing fields and indexes are added and their
+// rules are replaced, while their existing fields and records are kept.
+func saveCollections(db dbx.Builder, collections ...*models.Collection) error {
+	dao := daos.New(db)
+	for _, collection := range collections {
+		if err := resolveRelations(dao, collection); err != nil {
+			return err
+		}
+
+		existing, err := dao.FindCollectionByNameOrId(collection.Name)
+		if err != nil {
+			if err := dao.SaveCollection(collection); err != nil {
+				return fmt.Errorf("failed to create the %s collection: %w", collection.Name, err)
+			}
+			continue
+		}
+
+		addMissingFields(existing, collection.Schema.Fields()...)
+		addMissingIndexes(existing, collection.Indexes...)
+		existing.ListRule = collection.ListRule
+		existing.ViewRule = collection.ViewRule
+		existing.CreateRule = collection.CreateRule
+		existing.UpdateRule = collection.UpdateRule
+		existing.DeleteRule = collection.DeleteRule
+
+		if err := dao.SaveCollection(existing); err != nil {
+			return fmt.Errorf("failed to update the %s collection: %w", collection.Name, err)
+		}
+	}
+	return nil
+}
+
+// deleteCollections deletes the collections in order.
+func deleteCollections(db dbx.Builder, names ...string) error {
+	dao := daos.New(db)
+	for _, name := range names {
+		collection, err := dao.FindCollectionByNameOrId(name)
+		if err != nil {
+			continue
+		}
+
+		if err := dao.DeleteCollection(collection); err != nil {
+			return err
+		}
+	}
+	return nil
+}
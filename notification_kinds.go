@@ -0,0 +1,756 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// NotificationAction is an action button displayed along with the notification.
+type NotificationAction struct {
+	Type               string
+	ShowsUserInterface bool
+}
+
+// NotificationKind describes how a specific kind of notification is rendered by the app.
+//
+// The localized title, body and action texts are looked up in the notification catalog
+// using the kind's name.
+type NotificationKind struct {
+	Name string
+
+	// Id is the local notification id used by the app. Notifications
+	// with the same id replace each other on the device.
+	Id int
+
+	// Version is bumped whenever the payload changes in a way that
+	// the app needs to know about.
+	Version int
+
+	// DataSchema lists the keys that must be present in the data payload.
+	DataSchema []string
+
+	Importance string
+	Priority   string
+	Actions    []NotificationAction
+	Details    map[string]any
+
+	// CollapseKey returns the key shared by the notifications that replace
+	// each other on the device (e.g. the notifications of the same call).
+	// Notifications of the kind are not collapsed if it is nil.
+	CollapseKey func(data map[string]string) string
+
+	// Android settings
+	AndroidPriority string
+	TTL             time.Duration
+
+	// iOS settings
+	APNSCategory          string
+	APNSInterruptionLevel string
+
+	// Unlimited kinds are not counted by the push rate limiter
+	// (e.g. chat messages, whose bursts are grouped instead)
+	Unlimited bool
+
+	// VoIP marks the kind to be delivered as a PushKit VoIP push
+	// to iOS devices with a registered VoIP token.
+	VoIP bool
+
+	// Web settings
+	RequireInteraction bool
+
+	// WebLink returns the url, relative to the web app, of the
+	// page opened when the notification is clicked.
+	WebLink func(data map[string]string) string
+}
+
+// webAppUrl is the base url of the web app used for notification links.
+var webAppUrl = os.Getenv("WEB_APP_URL")
+
+// NotificationParams are the typed parameters used for building a
+// notification of a specific kind.
+type NotificationParams interface {
+	Kind() string
+	ImageUrl() string
+	MessageArgs() (titleArgs []any, bodyArgs []any)
+	Data() map[string]string
+}
+
+var notificationKinds = map[string]*NotificationKind{}
+
+func registerNotificationKind(kind *NotificationKind) *NotificationKind {
+	if _, exists := notificationKinds[kind.Name]; exists {
+		panic(fmt.Sprintf("notification kind %q is already registered", kind.Name))
+	}
+
+	notificationKinds[kind.Name] = kind
+	return kind
+}
+
+func findNotificationKind(name string) (*NotificationKind, error) {
+	kind, ok := notificationKinds[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown notification kind %q", name)
+	}
+	return kind, nil
+}
+
+// renderedNotification is the localized content of a notification.
+type renderedNotification struct {
+	Title       string
+	Body        string
+	ImageUrl    string
+	Data        map[string]string
+	CollapseKey string
+	Badge       int
+}
+
+func (k *NotificationKind) render(params NotificationParams, locale string, badge int) (*renderedNotification, error) {
+	data := params.Data()
+	for _, key := range k.DataSchema {
+		if _, ok := data[key]; !ok {
+			return nil, fmt.Errorf("%s notification is missing %q", k.Name, key)
+		}
+	}
+
+	locale = normalizeLocale(locale)
+	msg := localizeNotification(locale, k.Name)
+	title, body := msg.Format(params.MessageArgs())
+	imageUrl := params.ImageUrl()
+
+	actions := make([]map[string]any, len(k.Actions))
+	for idx, action := range k.Actions {
+		actions[idx] = map[string]any{
+			"type":                 action.Type,
+			"text":                 msg.Actions[action.Type],
+			"shows_user_interface": action.ShowsUserInterface,
+		}
+	}
+
+	// separate notification data to be put into data payload
+	// as a JSON string to be parsed by the app
+	//
+	// this is to avoid FCM from automatically showing the notification
+	notifJson, err := json.Marshal(map[string]any{
+		"id":         k.Id,
+		"type":       k.Name,
+		"version":    k.Version,
+		"title":      title,
+		"body":       body,
+		"image_url":  imageUrl,
+		"importance": k.Importance,
+		"priority":   k.Priority,
+		"actions":    actions,
+		"details":    k.Details,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	payload := map[string]string{
+		"type":         k.Name,
+		"version":      strconv.Itoa(k.Version),
+		"notification": string(notifJson),
+		"image_url":    imageUrl,
+		"locale":       locale,
+		"badge":        strconv.Itoa(badge),
+	}
+
+	for key, value := range data {
+		payload[key] = value
+	}
+
+	collapseKey := ""
+	if k.CollapseKey != nil {
+		collapseKey = k.Name + ":" + k.CollapseKey(data)
+	}
+
+	return &renderedNotification{
+		Title:       title,
+		Body:        body,
+		ImageUrl:    imageUrl,
+		Data:        payload,
+		CollapseKey: collapseKey,
+		Badge:       badge,
+	}, nil
+}
+
+// limitCollapseKey shortens collapse keys longer than the limit of
+// the push service into a hash of the key.
+func limitCollapseKey(key string, limit int) string {
+	if len(key) <= limit {
+		return key
+	}
+
+	hash := sha256.Sum256([]byte(key))
+	return base64.RawURLEncoding.EncodeToString(hash[:])[:limit]
+}
+
+func (k *NotificationKind) apnsHeaders(pushType string, rendered *renderedNotification) map[string]string {
+	priority := "5"
+	if k.Priority == "high" {
+		priority = "10"
+	}
+
+	headers := map[string]string{
+		"apns-push-type":  pushType,
+		"apns-priority":   priority,
+		"apns-expiration": strconv.FormatInt(time.Now().Add(k.TTL).Unix(), 10),
+	}
+
+	if len(rendered.CollapseKey) != 0 {
+		headers["apns-collapse-id"] = limitCollapseKey(rendered.CollapseKey, 64)
+	}
+
+	return headers
+}
+
+func (k *NotificationKind) actionTypes() []string {
+	actionTypes := make([]string, len(k.Actions))
+	for idx, action := range k.Actions {
+		actionTypes[idx] = action.Type
+	}
+	return actionTypes
+}
+
+// Build builds the message of the notification for the tokens of the platform.
+// The badge is the number of unread messages shown on the app icon.
+func (k *NotificationKind) Build(params NotificationParams, locale string, platform string, badge int, tokens []string) (*messaging.MulticastMessage, error) {
+	if platform == platformVoIP && !k.VoIP {
+		return nil, fmt.Errorf("%s notification cannot be sent as a VoIP push", k.Name)
+	}
+
+	rendered, err := k.render(params, locale, badge)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &messaging.MulticastMessage{
+		Tokens: tokens,
+	}
+
+	switch platform {
+	case platformAndroid:
+		message.Data = rendered.Data
+		message.Android = k.androidConfig(rendered)
+	case platformIOS:
+		message.Data = rendered.Data
+		message.APNS = k.apnsConfig(rendered)
+	case platformWeb:
+		message.Data = rendered.Data
+		message.Webpush = k.webpushConfig(rendered)
+	case platformVoIP:
+		message.APNS = k.voipConfig(rendered)
+	default:
+		message.Data = rendered.Data
+		message.Android = k.androidConfig(rendered)
+		message.APNS = k.apnsConfig(rendered)
+	}
+
+	return message, nil
+}
+
+func (k *NotificationKind) androidConfig(rendered *renderedNotification) *messaging.AndroidConfig {
+	ttl := k.TTL
+	return &messaging.AndroidConfig{
+		CollapseKey: rendered.CollapseKey,
+		Priority:    k.AndroidPriority,
+		TTL:         &ttl,
+	}
+}
+
+// apnsConfig returns the APNs config of the notification.
+//
+// unlike android, a data-only push will not wake a terminated
+// iOS app so an alert needs to be sent instead
+func (k *NotificationKind) apnsConfig(rendered *renderedNotification) *messaging.APNSConfig {
+	apsData := map[string]any{}
+	if len(k.APNSInterruptionLevel) != 0 {
+		apsData["interruption-level"] = k.APNSInterruptionLevel
+	}
+
+	config := &messaging.APNSConfig{
+		Headers: k.apnsHeaders("alert", rendered),
+		Payload: &messaging.APNSPayload{
+			Aps: &messaging.Aps{
+				Alert: &messaging.ApsAlert{
+					Title: rendered.Title,
+					Body:  rendered.Body,
+				},
+				Badge:          &rendered.Badge,
+				Sound:          "default",
+				Category:       k.APNSCategory,
+				MutableContent: len(rendered.ImageUrl) != 0,
+				CustomData:     apsData,
+			},
+			CustomData: map[string]any{
+				"actions": k.actionTypes(),
+			},
+		},
+	}
+
+	if len(rendered.ImageUrl) != 0 {
+		config.FCMOptions = &messaging.APNSFCMOptions{
+			ImageURL: rendered.ImageUrl,
+		}
+	}
+
+	return config
+}
+
+// voipConfig returns the APNs config of the notification for VoIP tokens.
+// The app reports the call to CallKit using the payload's data.
+func (k *NotificationKind) voipConfig(rendered *renderedNotification) *messaging.APNSConfig {
+	customData := map[string]any{
+		"actions": k.actionTypes(),
+	}
+
+	for key, value := range rendered.Data {
+		customData[key] = value
+	}
+
+	return &messaging.APNSConfig{
+		Headers: k.apnsHeaders("voip", rendered),
+		Payload: &messaging.APNSPayload{
+			Aps: &messaging.Aps{
+				Category: k.APNSCategory,
+			},
+			CustomData: customData,
+		},
+	}
+}
+
+// webpushConfig returns the web push config of the notification. Unlike the
+// mobile apps, browsers display the notification as-is.
+func (k *NotificationKind) webpushConfig(rendered *renderedNotification) *messaging.WebpushConfig {
+	msg := localizeNotification(rendered.Data["locale"], k.Name)
+	actions := make([]*messaging.WebpushNotificationAction, len(k.Actions))
+	for idx, action := range k.Actions {
+		actions[idx] = &messaging.WebpushNotificationAction{
+			Action: action.Type,
+			Title:  msg.Actions[action.Type],
+		}
+	}
+
+	urgency := "normal"
+	if k.Priority == "high" {
+		urgency = "high"
+	}
+
+	config := &messaging.WebpushConfig{
+		Headers: map[string]string{
+			"TTL":     strconv.Itoa(int(k.TTL.Seconds())),
+			"Urgency": urgency,
+		},
+		Notification: &messaging.WebpushNotification{
+			Title:              rendered.Title,
+			Body:               rendered.Body,
+			Icon:               rendered.ImageUrl,
+			Actions:            actions,
+			Language:           rendered.Data["locale"],
+			Tag:                k.Name,
+			RequireInteraction: k.RequireInteraction,
+		},
+	}
+
+	// topics may only contain url-safe base64 characters
+	// so the collapse key is always hashed
+	if len(rendered.CollapseKey) != 0 {
+		hash := sha256.Sum256([]byte(rendered.CollapseKey))
+		config.Headers["Topic"] = base64.RawURLEncoding.EncodeToString(hash[:])[:32]
+		config.Notification.Tag = rendered.CollapseKey
+	}
+
+	// the link must be an absolute https url
+	if k.WebLink != nil && len(webAppUrl) != 0 {
+		base, baseErr := url.Parse(strings.TrimSuffix(webAppUrl, "/") + "/")
+		link, linkErr := url.Parse(k.WebLink(rendered.Data))
+		if baseErr == nil && linkErr == nil {
+			config.FCMOptions = &messaging.WebpushFCMOptions{
+				Link: base.ResolveReference(link).String(),
+			}
+		}
+	}
+
+	return config
+}
+
+var incomingCallNotification = registerNotificationKind(&NotificationKind{
+	Name:       "incoming_call",
+	Id:         1,
+	Version:    1,
+	DataSchema: []string{"call_type", "invitee", "chat_id", "from_chat_type"},
+	Importance: "max",
+	Priority:   "high",
+	Actions: []NotificationAction{
+		{Type: "accept_call_action", ShowsUserInterface: true},
+		{Type: "decline_call_action", ShowsUserInterface: false},
+	},
+	Details: map[string]any{
+		"full_screen_intent": true,
+	},
+	AndroidPriority:       "high",
+	TTL:                   5 * time.Minute,
+	APNSCategory:          "INCOMING_CALL",
+	APNSInterruptionLevel: "time-sensitive",
+	VoIP:                  true,
+	RequireInteraction:    true,
+	CollapseKey: func(data map[string]string) string {
+		return makeChatIdentifier(data["from_chat_type"], data["chat_id"])
+	},
+	WebLink: func(data map[string]string) string {
+		return "calls/join?" + url.Values{
+			"from_chat_type": {data["from_chat_type"]},
+			"chat_id":        {data["chat_id"]},
+			"type":           {data["call_type"]},
+		}.Encode()
+	},
+})
+
+// IncomingCallParams are the params of the incoming_call notification.
+type IncomingCallParams struct {
+	Caller         *models.Record
+	CallerImageUrl string
+	CallType       string
+	ChatId         string
+	FromChatType   string
+}
+
+func (p IncomingCallParams) Kind() string {
+	return incomingCallNotification.Name
+}
+
+func (p IncomingCallParams) ImageUrl() string {
+	return p.CallerImageUrl
+}
+
+func (p IncomingCallParams) MessageArgs() ([]any, []any) {
+	return nil, []any{p.Caller.GetString("name")}
+}
+
+func (p IncomingCallParams) Data() map[string]string {
+	inviteeJson, _ := json.Marshal(p.Caller.PublicExport())
+	return map[string]string{
+		"call_type":      p.CallType,
+		"invitee":        string(inviteeJson),
+		"chat_id":        p.ChatId,
+		"from_chat_type": p.FromChatType,
+	}
+}
+
+var communityReminderNotification = registerNotificationKind(&NotificationKind{
+	Name:            "community_reminder",
+	Id:              2,
+	Version:         1,
+	DataSchema:      []string{"chat_id", "from_chat_type", "schedule_id"},
+	Importance:      "default",
+	Priority:        "default",
+	AndroidPriority: "normal",
+	TTL:             12 * time.Hour,
+	CollapseKey: func(data map[string]string) string {
+		return data["schedule_id"]
+	},
+	WebLink: func(data map[string]string) string {
+		return "chats?" + url.Values{
+			"from_chat_type": {data["from_chat_type"]},
+			"chat_id":        {data["chat_id"]},
+		}.Encode()
+	},
+})
+
+// CommunityReminderParams are the params of the recurring reminders
+// sent by a community to the members of its chat.
+type CommunityReminderParams struct {
+	CommunityName     string
+	CommunityImageUrl string
+	Message           string
+	ChatId            string
+	ScheduleId        string
+}
+
+func (p CommunityReminderParams) Kind() string {
+	return communityReminderNotification.Name
+}
+
+func (p CommunityReminderParams) ImageUrl() string {
+	return p.CommunityImageUrl
+}
+
+func (p CommunityReminderParams) MessageArgs() ([]any, []any) {
+	return []any{p.CommunityName}, []any{p.Message}
+}
+
+func (p CommunityReminderParams) Data() map[string]string {
+	return map[string]string{
+		"chat_id":        p.ChatId,
+		"from_chat_type": communityChatKind.Name,
+		"schedule_id":    p.ScheduleId,
+	}
+}
+
+// newChatMessageKind returns the kind of the notifications of new chat messages.
+// A single message and a burst of messages share the same local id so
+// that they replace each other on the device.
+func newChatMessageKind(name string) *NotificationKind {
+	return &NotificationKind{
+		Name:            name,
+		Id:              3,
+		Version:         1,
+		DataSchema:      []string{"chat_id", "from_chat_type", "message_id", "sender"},
+		Importance:      "default",
+		Priority:        "default",
+		AndroidPriority: "normal",
+		TTL:             24 * time.Hour,
+		Unlimited:       true,
+		CollapseKey: func(data map[string]string) string {
+			return makeChatIdentifier(data["from_chat_type"], data["chat_id"])
+		},
+		WebLink: func(data map[string]string) string {
+			return "chats?" + url.Values{
+				"from_chat_type": {data["from_chat_type"]},
+				"chat_id":        {data["chat_id"]},
+			}.Encode()
+		},
+	}
+}
+
+var chatMessageNotification = registerNotificationKind(newChatMessageKind("chat_message"))
+var chatMessagesNotification = registerNotificationKind(newChatMessageKind("chat_messages"))
+
+// ChatMessageParams are the params of the notification of a new chat message.
+// Count is the number of messages the recipients have not seen yet.
+type ChatMessageParams struct {
+	Sender         *models.Record
+	SenderImageUrl string
+	MessageId      string
+	Text           string
+	ChatId         string
+	FromChatType   string
+	Count          int
+}
+
+func (p ChatMessageParams) Kind() string {
+	if p.Count > 1 {
+		return chatMessagesNotification.Name
+	}
+	return chatMessageNotification.Name
+}
+
+func (p ChatMessageParams) ImageUrl() string {
+	return p.SenderImageUrl
+}
+
+func (p ChatMessageParams) MessageArgs() ([]any, []any) {
+	if p.Count > 1 {
+		return []any{p.Sender.GetString("name")}, []any{p.Count}
+	}
+	return []any{p.Sender.GetString("name")}, []any{p.Text}
+}
+
+func (p ChatMessageParams) Data() map[string]string {
+	return map[string]string{
+		"chat_id":        p.ChatId,
+		"from_chat_type": p.FromChatType,
+		"message_id":     p.MessageId,
+		"sender":         p.Sender.Id,
+	}
+}
+
+var chatMentionNotification = registerNotificationKind(&NotificationKind{
+	Name:            "chat_mention",
+	Id:              4,
+	Version:         1,
+	DataSchema:      []string{"chat_id", "from_chat_type", "message_id", "sender"},
+	Importance:      "high",
+	Priority:        "high",
+	AndroidPriority: "high",
+	TTL:             24 * time.Hour,
+	Unlimited:       true,
+	CollapseKey: func(data map[string]string) string {
+		return data["message_id"]
+	},
+	WebLink: func(data map[string]string) string {
+		return "chats?" + url.Values{
+			"from_chat_type": {data["from_chat_type"]},
+			"chat_id":        {data["chat_id"]},
+			"message_id":     {data["message_id"]},
+		}.Encode()
+	},
+})
+
+// ChatMentionParams are the params of the notification of a message
+// which mentions the recipients.
+type ChatMentionParams struct {
+	Sender         *models.Record
+	SenderImageUrl string
+	MessageId      string
+	Text           string
+	ChatId         string
+	FromChatType   string
+}
+
+func (p ChatMentionParams) Kind() string {
+	return chatMentionNotification.Name
+}
+
+func (p ChatMentionParams) ImageUrl() string {
+	return p.SenderImageUrl
+}
+
+func (p ChatMentionParams) MessageArgs() ([]any, []any) {
+	return []any{p.Sender.GetString("name")}, []any{p.Text}
+}
+
+func (p ChatMentionParams) Data() map[string]string {
+	return map[string]string{
+		"chat_id":        p.ChatId,
+		"from_chat_type": p.FromChatType,
+		"message_id":     p.MessageId,
+		"sender":         p.Sender.Id,
+	}
+}
+
+// newCallRemovedKind returns the kind of the notifications sent to the users who
+// can no longer join the call of a chat. The app dismisses the ringing call when
+// it receives one. Unlike incoming calls, they are not sent as VoIP pushes since
+// iOS requires every VoIP push to report a new call, and most of the users were
+// never rung or have already declined.
+func newCallRemovedKind(name string) *NotificationKind {
+	return &NotificationKind{
+		Name:            name,
+		Id:              6,
+		Version:         1,
+		DataSchema:      []string{"chat_id", "from_chat_type", "room_id"},
+		Importance:      "default",
+		Priority:        "high",
+		AndroidPriority: "high",
+		TTL:             5 * time.Minute,
+		CollapseKey: func(data map[string]string) string {
+			return data["room_id"]
+		},
+	}
+}
+
+// reasons why users can no longer join the call of a chat
+const (
+	callRemovedMemberRemoved = "member_removed"
+	callRemovedChatDeleted   = "chat_deleted"
+	callRemovedCallsDisabled = "calls_disabled"
+)
+
+// callRemovedNotifications are the kinds of the notifications of each reason
+// why users can no longer join the call of a chat.
+var callRemovedNotifications = map[string]*NotificationKind{
+	callRemovedMemberRemoved: registerNotificationKind(newCallRemovedKind("call_member_removed")),
+	callRemovedChatDeleted:   registerNotificationKind(newCallRemovedKind("call_chat_deleted")),
+	callRemovedCallsDisabled: registerNotificationKind(newCallRemovedKind("call_calls_disabled")),
+}
+
+// CallRemovedParams are the params of the notification sent to the users
+// who can no longer join the call, either because they were removed from
+// the chat, the chat was deleted or the chat no longer allows calls (e.g. a
+// withdrawn chat request).
+type CallRemovedParams struct {
+	RoomId       string
+	ChatId       string
+	FromChatType string
+	Reason       string
+}
+
+func (p CallRemovedParams) Kind() string {
+	if kind, exists := callRemovedNotifications[p.Reason]; exists {
+		return kind.Name
+	}
+	return callRemovedNotifications[callRemovedMemberRemoved].Name
+}
+
+func (p CallRemovedParams) ImageUrl() string {
+	return ""
+}
+
+func (p CallRemovedParams) MessageArgs() ([]any, []any) {
+	return nil, nil
+}
+
+func (p CallRemovedParams) Data() map[string]string {
+	return map[string]string{
+		"chat_id":        p.ChatId,
+		"from_chat_type": p.FromChatType,
+		"room_id":        p.RoomId,
+	}
+}
+
+// newChatRequestKind returns the kind of the notifications of a status of
+// a chat request. The statuses share the same local id so that the latest
+// status replaces the previous one on the device.
+func newChatRequestKind(name string) *NotificationKind {
+	return &NotificationKind{
+		Name:            name,
+		Id:              5,
+		Version:         1,
+		DataSchema:      []string{"chat_id", "from_chat_type", "status", "actor"},
+		Importance:      "default",
+		Priority:        "default",
+		AndroidPriority: "normal",
+		TTL:             7 * 24 * time.Hour,
+		CollapseKey: func(data map[string]string) string {
+			return makeChatIdentifier(data["from_chat_type"], data["chat_id"])
+		},
+		WebLink: func(data map[string]string) string {
+			return "chats?" + url.Values{
+				"from_chat_type": {data["from_chat_type"]},
+				"chat_id":        {data["chat_id"]},
+			}.Encode()
+		},
+	}
+}
+
+// chatRequestKinds are the kinds of the notifications of each status of a chat request
+var chatRequestKinds = map[string]*NotificationKind{
+	chatRequestStatusPending:   registerNotificationKind(newChatRequestKind("chat_request_sent")),
+	chatRequestStatusAccepted:  registerNotificationKind(newChatRequestKind("chat_request_accepted")),
+	chatRequestStatusDeclined:  registerNotificationKind(newChatRequestKind("chat_request_declined")),
+	chatRequestStatusWithdrawn: registerNotificationKind(newChatRequestKind("chat_request_withdrawn")),
+}
+
+// ChatRequestParams are the params of the notification sent to the other
+// party of a chat request when the actor changes its status.
+type ChatRequestParams struct {
+	Actor         *models.Record
+	ActorImageUrl string
+	ChatId        string
+	Status        string
+}
+
+func (p ChatRequestParams) Kind() string {
+	if kind, ok := chatRequestKinds[p.Status]; ok {
+		return kind.Name
+	}
+	return ""
+}
+
+func (p ChatRequestParams) ImageUrl() string {
+	return p.ActorImageUrl
+}
+
+func (p ChatRequestParams) MessageArgs() ([]any, []any) {
+	return nil, []any{p.Actor.GetString("name")}
+}
+
+func (p ChatRequestParams) Data() map[string]string {
+	return map[string]string{
+		"chat_id":        p.ChatId,
+		"from_chat_type": dsChatKind.Name,
+		"status":         p.Status,
+		"actor":          p.Actor.Id,
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "container/heap"
+
+// notificationQueue is a min-heap of the pending notifications
+// ordered by their scheduled time.
+type notificationQueue []*ScheduledNotification
+
+var _ heap.Interface = (*notificationQueue)(nil)
+
+func (q notificationQueue) Len() int {
+	return len(q)
+}
+
+func (q notificationQueue) Less(i, j int) bool {
+	return q[i].ScheduledTime.Before(q[j].ScheduledTime)
+}
+
+func (q notificationQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].queueIndex = i
+	q[j].queueIndex = j
+}
+
+func (q *notificationQueue) Push(x any) {
+	notif := x.(*ScheduledNotification)
+	notif.queueIndex = len(*q)
+	*q = append(*q, notif)
+}
+
+func (q *notificationQueue) Pop() any {
+	old := *q
+	last := len(old) - 1
+	notif := old[last]
+	old[last] = nil
+	notif.queueIndex = -1
+	*q = old[:last]
+	return notif
+}
+
+// peek returns the notification scheduled the earliest.
+func (q notificationQueue) peek() *ScheduledNotification {
+	if len(q) == 0 {
+		return nil
+	}
+	return q[0]
+}
@@ -1,17 +1,60 @@
 package main
 
 import (
+	"container/heap"
 	"context"
+	"errors"
+	"io"
 	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
+	"firebase.google.com/go/v4/errorutils"
 	"firebase.google.com/go/v4/messaging"
 	gonanoid "github.com/matoous/go-nanoid/v2"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 )
 
-var maxConcurrentNotifications = 3600
-var notificationSem = make(chan struct{}, maxConcurrentNotifications)
+// sendWorkers is the number of notifications that are sent concurrently
+var sendWorkers = 8
+
+// maxTokenFailures is the number of consecutive sends rejected
+// because of an invalid argument before a token is considered invalid
+var maxTokenFailures = 10
+
+// maxNotificationHistory is the number of sent or cancelled
+// notifications kept for inspection
+var maxNotificationHistory = 500
+
+// statuses of a scheduled notification
+const (
+	notificationStatusPending   = "pending"
+	notificationStatusSending   = "sending"
+	notificationStatusSent      = "sent"
+	notificationStatusFailed    = "failed"
+	notificationStatusRetrying  = "retrying"
+	notificationStatusDead      = "dead"
+	notificationStatusCancelled = "cancelled"
+	notificationStatusPaused    = "paused"
+)
+
+// shutdownFlushWindow is how soon a notification must be due
+// for it to be sent before the scheduler shuts down
+var shutdownFlushWindow = 5 * time.Second
+
+// defaultDedupeWindow is how long a dedupe key is remembered for each token
+var defaultDedupeWindow = 1 * time.Minute
+
+// retry settings of failed sends
+var defaultMaxSendAttempts = 5
+var retryBaseDelay = 1 * time.Second
+var retryMaxDelay = 5 * time.Minute
 
 type ScheduledNotification struct {
 	Id               string
@@ -19,84 +62,1175 @@ type ScheduledNotification struct {
 	MulticastMessage *messaging.MulticastMessage
 	ScheduledTime    time.Time
 	CompletionStatus bool
+
+	// Transport is the name of the transport used for sending
+	// the notification. Defaults to FCM if not set.
+	Transport string
+
+	// Attempts is the number of times the notification has been sent.
+	// MaxAttempts defaults to defaultMaxSendAttempts if not set.
+	Attempts    int
+	MaxAttempts int
+
+	// Tags are used for cancelling related notifications at once
+	// (e.g. all of the notifications of a call room)
+	Tags []string
+
+	// Kind and Recipients (user ids) are used for inspecting the notification
+	Kind       string
+	Recipients []string
+
+	// DedupeKey drops the tokens which have already been scheduled a
+	// notification with the same key within the DedupeWindow (defaults
+	// to defaultDedupeWindow). Notifications are not deduped if it is empty.
+	DedupeKey    string
+	DedupeWindow time.Duration
+
+	// Recurrence schedules the next occurrence of the notification
+	// after it has been sent. Nil for one-off notifications.
+	Recurrence *Recurrence
+
+	Status       string
+	SentAt       time.Time
+	FailedTokens []string
+	LastError    string
+
+	queueIndex int
+	cancelled  bool
+	sending    bool
 }
 
+// NotificationScheduler keeps the pending notifications in a queue ordered
+// by their scheduled time. A single timer wakes the dispatcher when the
+// earliest notification is due, which then hands it to the send workers
+// through the Notifier channel.
 type NotificationScheduler struct {
-	mutex           sync.Mutex
-	MessagingClient *messaging.Client
-	Notifier        chan<- *ScheduledNotification
-	Notifs          map[string]*ScheduledNotification
+	mutex      sync.Mutex
+	Transports map[string]PushTransport
+	Notifier   chan<- *ScheduledNotification
+	Notifs     map[string]*ScheduledNotification
+
+	// OnInvalidToken is called for each token that is no longer
+	// valid and should be removed from its owner
+	OnInvalidToken func(token string)
+
+	// OnDeadLetter is called with the notification (containing only
+	// the failed tokens) that still fails after its last attempt or
+	// fails with an error that can not be retried
+	OnDeadLetter func(notif *ScheduledNotification, lastErr error)
+
+	// LoadDeadLetter returns the stored dead letter of the notification
+	// with the id, or nil if there is none
+	LoadDeadLetter func(id string) *ScheduledNotification
+
+	queue         notificationQueue
+	wake          chan struct{}
+	history       []*ScheduledNotification
+	tokenFailures map[string]int
+
+	// tagged keeps the pending notifications by their tags
+	// so that they can be cancelled without a scan
+	tagged map[string]map[string]*ScheduledNotification
+
+	// series keeps the state of the recurring notifications by their series id
+	series map[string]*notificationSeries
+
+	// dedupeKeys keeps when each token was last scheduled a
+	// notification, keyed by dedupe key and then by token
+	dedupeKeys map[string]map[string]time.Time
+
+	// closed stops new notifications from being added once the
+	// scheduler is shutting down
+	closed         bool
+	stop           chan struct{}
+	dispatcherDone chan struct{}
+	workersDone    chan struct{}
+}
+
+// notificationSeries is the state of a series of recurring notifications.
+// The occurrences of a paused series are kept in Notifs without being queued.
+type notificationSeries struct {
+	paused bool
 }
 
 func NewNotificationScheduler(notifier chan<- *ScheduledNotification) *NotificationScheduler {
 	return &NotificationScheduler{
-		Notifier: notifier,
-		Notifs:   make(map[string]*ScheduledNotification),
+		Notifier:       notifier,
+		Notifs:         make(map[string]*ScheduledNotification),
+		Transports:     make(map[string]PushTransport),
+		wake:           make(chan struct{}, 1),
+		tokenFailures:  make(map[string]int),
+		tagged:         make(map[string]map[string]*ScheduledNotification),
+		series:         make(map[string]*notificationSeries),
+		dedupeKeys:     make(map[string]map[string]time.Time),
+		stop:           make(chan struct{}),
+		dispatcherDone: make(chan struct{}),
+		workersDone:    make(chan struct{}),
 	}
 }
 
-func (n *NotificationScheduler) AddNotification(notif *ScheduledNotification) {
+// AddNotification schedules the notification and returns its id. An empty id
+// is returned if the notification is a duplicate for all of its tokens.
+//
+// The id is also included in the payload as "notification_id" so that
+// the app can report receipts of the notification.
+func (n *NotificationScheduler) AddNotification(notif *ScheduledNotification) string {
+	n.mutex.Lock()
+	closed := n.closed
+	n.mutex.Unlock()
+
+	if closed {
+		log.Default().Printf("Dropping %s notification: the scheduler is shutting down\n", notif.Kind)
+		return ""
+	}
+
+	if len(notif.DedupeKey) != 0 && !n.dedupe(notif) {
+		log.Default().Printf("Dropping duplicate notification %q\n", notif.DedupeKey)
+		return ""
+	}
+
 	id, _ := gonanoid.New()
 	notif.Id = id
+	attachNotificationId(notif)
+
+	if notif.Recurrence != nil {
+		n.mutex.Lock()
+		if _, exists := n.series[notif.Recurrence.SeriesId]; !exists {
+			n.series[notif.Recurrence.SeriesId] = &notificationSeries{}
+		}
+		n.mutex.Unlock()
+	}
+
+	n.schedule(notif)
+	return id
+}
+
+// RestoreNotification schedules a notification that was pending when
+// the scheduler last shut down, keeping its id.
+func (n *NotificationScheduler) RestoreNotification(notif *ScheduledNotification) {
+	n.schedule(notif)
+}
+
+// dedupe removes the tokens of the notification which have been scheduled
+// a notification with the same dedupe key within the window and remembers
+// the remaining ones. It returns false if there are no tokens left.
+func (n *NotificationScheduler) dedupe(notif *ScheduledNotification) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	now := time.Now()
+	window := notif.DedupeWindow
+	if window <= 0 {
+		window = defaultDedupeWindow
+	}
+
+	// forget the keys that have expired
+	for key, tokens := range n.dedupeKeys {
+		maps.DeleteFunc(tokens, func(_ string, expiry time.Time) bool {
+			return !expiry.After(now)
+		})
+		if len(tokens) == 0 {
+			delete(n.dedupeKeys, key)
+		}
+	}
+
+	seen := n.dedupeKeys[notif.DedupeKey]
+	if seen == nil {
+		seen = map[string]time.Time{}
+		n.dedupeKeys[notif.DedupeKey] = seen
+	}
+
+	if notif.Message != nil {
+		if _, isDuplicate := seen[notif.Message.Token]; isDuplicate {
+			return false
+		}
+		seen[notif.Message.Token] = now.Add(window)
+	}
+
+	if notif.MulticastMessage != nil {
+		tokens := []string{}
+		for _, token := range notif.MulticastMessage.Tokens {
+			if _, isDuplicate := seen[token]; !isDuplicate {
+				tokens = append(tokens, token)
+				seen[token] = now.Add(window)
+			}
+		}
+
+		if len(tokens) == 0 {
+			return false
+		}
+
+		message := *notif.MulticastMessage
+		message.Tokens = tokens
+		notif.MulticastMessage = &message
+	}
+
+	return true
+}
+
+// IsDuplicate checks if the token has been scheduled a notification
+// with the dedupe key within the dedupe window.
+func (n *NotificationScheduler) IsDuplicate(key string, token string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
 
+	expiry, seen := n.dedupeKeys[key][token]
+	return seen && expiry.After(time.Now())
+}
+
+// ForgetDedupeKey allows notifications with the dedupe key to
+// be scheduled again before the dedupe window has passed.
+func (n *NotificationScheduler) ForgetDedupeKey(key string) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
+	delete(n.dedupeKeys, key)
+}
+
+// attachNotificationId adds the notification id to a copy of the
+// payload of the notification's message.
+func attachNotificationId(notif *ScheduledNotification) {
+	if notif.Message != nil {
+		message := *notif.Message
+		message.Data = withNotificationId(message.Data, notif.Id)
+		notif.Message = &message
+	}
+
+	if notif.MulticastMessage != nil {
+		message := *notif.MulticastMessage
+		if notif.Transport == transportAPNSVoIP && message.APNS != nil && message.APNS.Payload != nil {
+			// VoIP pushes only have the APNs payload
+			config := *message.APNS
+			payload := *config.Payload
+			payload.CustomData = maps.Clone(payload.CustomData)
+			if payload.CustomData == nil {
+				payload.CustomData = map[string]any{}
+			}
+			payload.CustomData["notification_id"] = notif.Id
+			config.Payload = &payload
+			message.APNS = &config
+		} else {
+			message.Data = withNotificationId(message.Data, notif.Id)
+		}
+		notif.MulticastMessage = &message
+	}
+}
+
+func withNotificationId(data map[string]string, id string) map[string]string {
+	data = maps.Clone(data)
+	if data == nil {
+		data = map[string]string{}
+	}
+	data["notification_id"] = id
+	return data
+}
+
+func (n *NotificationScheduler) schedule(notif *ScheduledNotification) {
+	n.mutex.Lock()
+	isEarliest := n.scheduleLocked(notif)
+	n.mutex.Unlock()
+
+	// the timer only needs to be reset if the
+	// notification is due before everything else
+	if isEarliest {
+		n.wakeDispatcher()
+	}
+}
+
+// scheduleLocked queues the notification and reports whether
+// it is now the earliest notification in the queue.
+func (n *NotificationScheduler) scheduleLocked(notif *ScheduledNotification) bool {
+	notif.cancelled = false
+	notif.sending = false
+	notif.Status = notificationStatusPending
+
+	n.trackLocked(notif)
+	heap.Push(&n.queue, notif)
+	return n.queue.peek() == notif
+}
+
+func (n *NotificationScheduler) wakeDispatcher() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// popDue removes the notifications that are due from the queue. It also
+// returns the time of the next notification, or zero if the queue is empty.
+func (n *NotificationScheduler) popDue(now time.Time) ([]*ScheduledNotification, time.Time) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	due := []*ScheduledNotification{}
+	for next := n.queue.peek(); next != nil; next = n.queue.peek() {
+		if next.ScheduledTime.After(now) {
+			return due, next.ScheduledTime
+		}
+
+		due = append(due, heap.Pop(&n.queue).(*ScheduledNotification))
+	}
+
+	return due, time.Time{}
+}
+
+// requeue puts the notifications that were popped but not sent back into the queue.
+func (n *NotificationScheduler) requeue(notifs []*ScheduledNotification) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for _, notif := range notifs {
+		heap.Push(&n.queue, notif)
+	}
+}
+
+// dispatch waits for the earliest notification to be due and hands
+// the due notifications to the send workers until the scheduler stops.
+func (n *NotificationScheduler) dispatch() {
+	defer close(n.dispatcherDone)
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		due, next := n.popDue(time.Now())
+		for idx, notif := range due {
+			select {
+			case n.Notifier <- notif:
+			case <-n.stop:
+				n.requeue(due[idx:])
+				return
+			}
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+
+		select {
+		case <-timer.C:
+		case <-n.wake:
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// Shutdown stops the scheduler from accepting new notifications and sends
+// the notifications due within the flush window. It waits for the sends to
+// finish until the context is done and closes the Notifier so that the send
+// workers exit.
+//
+// It returns the notifications that are still pending.
+func (n *NotificationScheduler) Shutdown(ctx context.Context) []*ScheduledNotification {
+	n.mutex.Lock()
+	if n.closed {
+		n.mutex.Unlock()
+		return nil
+	}
+	n.closed = true
+	n.mutex.Unlock()
+
+	close(n.stop)
+	select {
+	case <-n.dispatcherDone:
+	case <-ctx.Done():
+		log.Default().Println("Timed out waiting for the notification dispatcher to stop")
+		return n.PendingNotifications()
+	}
+
+	due, _ := n.popDue(time.Now().Add(shutdownFlushWindow))
+	log.Default().Printf("Flushing %d notifications before shutting down\n", len(due))
+
+flush:
+	for idx, notif := range due {
+		select {
+		case n.Notifier <- notif:
+		case <-ctx.Done():
+			n.requeue(due[idx:])
+			break flush
+		}
+	}
+
+	close(n.Notifier)
+	select {
+	case <-n.workersDone:
+	case <-ctx.Done():
+		log.Default().Println("Timed out waiting for the notifications to be sent")
+	}
+
+	return n.PendingNotifications()
+}
+
+// markSending marks the notification as being sent and counts the attempt.
+// It returns false if the notification has been cancelled.
+func (n *NotificationScheduler) markSending(notif *ScheduledNotification) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if notif.cancelled || notif.Status == notificationStatusPaused {
+		return false
+	}
+
+	notif.sending = true
+	notif.Status = notificationStatusSending
+	notif.Attempts++
+	return true
+}
+
+func (n *NotificationScheduler) cancelLocked(notif *ScheduledNotification) {
+	notif.cancelled = true
+	notif.Status = notificationStatusCancelled
+	n.recordHistoryLocked(notif)
+
+	n.unqueueLocked(notif)
+	n.untrackLocked(notif)
+
+	if notif.Recurrence != nil {
+		n.forgetSeriesLocked(notif.Recurrence.SeriesId)
+	}
+}
+
+// trackLocked keeps the notification as pending.
+func (n *NotificationScheduler) trackLocked(notif *ScheduledNotification) {
 	n.Notifs[notif.Id] = notif
-	go n.monitorAndSend(notif)
+	for _, tag := range notif.Tags {
+		if _, exists := n.tagged[tag]; !exists {
+			n.tagged[tag] = map[string]*ScheduledNotification{}
+		}
+		n.tagged[tag][notif.Id] = notif
+	}
+}
+
+// untrackLocked forgets the notification once it is no longer pending.
+func (n *NotificationScheduler) untrackLocked(notif *ScheduledNotification) {
+	delete(n.Notifs, notif.Id)
+	for _, tag := range notif.Tags {
+		delete(n.tagged[tag], notif.Id)
+		if len(n.tagged[tag]) == 0 {
+			delete(n.tagged, tag)
+		}
+	}
+}
+
+// unqueueLocked removes the notification from the queue if it is still queued.
+func (n *NotificationScheduler) unqueueLocked(notif *ScheduledNotification) {
+	if notif.queueIndex >= 0 && notif.queueIndex < len(n.queue) && n.queue[notif.queueIndex] == notif {
+		heap.Remove(&n.queue, notif.queueIndex)
+	}
 }
 
-func (n *NotificationScheduler) monitorAndSend(notif *ScheduledNotification) {
+// Cancel prevents the notification from being sent. It returns false if
+// the notification does not exist or is already being sent.
+func (n *NotificationScheduler) Cancel(id string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	notif, exists := n.Notifs[id]
+	if !exists || notif.sending {
+		return false
+	}
+
+	n.cancelLocked(notif)
+	return true
+}
+
+// CancelByTag cancels all of the pending notifications with the tag and
+// returns the number of cancelled notifications.
+func (n *NotificationScheduler) CancelByTag(tag string) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	cancelled := 0
+	for _, notif := range n.tagged[tag] {
+		if notif.sending {
+			continue
+		}
+
+		n.cancelLocked(notif)
+		cancelled++
+	}
+
+	return cancelled
+}
+
+// seriesNotificationsLocked returns the pending occurrences of the series.
+func (n *NotificationScheduler) seriesNotificationsLocked(seriesId string) []*ScheduledNotification {
+	notifs := []*ScheduledNotification{}
+	for _, notif := range n.Notifs {
+		if notif.Recurrence != nil && notif.Recurrence.SeriesId == seriesId {
+			notifs = append(notifs, notif)
+		}
+	}
+	return notifs
+}
+
+// forgetSeriesLocked removes the series once it has no pending occurrences left.
+func (n *NotificationScheduler) forgetSeriesLocked(seriesId string) {
+	if len(n.seriesNotificationsLocked(seriesId)) == 0 {
+		delete(n.series, seriesId)
+	}
+}
+
+// PauseSeries stops the occurrences of the series from being sent until
+// the series is resumed. It returns false if the series does not exist.
+func (n *NotificationScheduler) PauseSeries(seriesId string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	series, exists := n.series[seriesId]
+	if !exists {
+		return false
+	}
+
+	series.paused = true
+	for _, notif := range n.seriesNotificationsLocked(seriesId) {
+		if notif.sending {
+			continue
+		}
+
+		n.unqueueLocked(notif)
+		notif.Status = notificationStatusPaused
+	}
+
+	return true
+}
+
+// ResumeSeries schedules the paused occurrences of the series at their next
+// occurrence. It returns false if the series does not exist.
+func (n *NotificationScheduler) ResumeSeries(seriesId string) bool {
+	n.mutex.Lock()
+
+	series, exists := n.series[seriesId]
+	if !exists {
+		n.mutex.Unlock()
+		return false
+	}
+
+	series.paused = false
 	now := time.Now()
-	if notif.ScheduledTime.After(now) {
-		time.Sleep(notif.ScheduledTime.Sub(now))
+	isEarliest := false
+
+	for _, notif := range n.seriesNotificationsLocked(seriesId) {
+		if notif.Status != notificationStatusPaused {
+			continue
+		}
+
+		// occurrences missed while paused are skipped
+		if notif.ScheduledTime.Before(now) {
+			notif.ScheduledTime = notif.Recurrence.Next(now)
+		}
+
+		if notif.ScheduledTime.IsZero() {
+			n.cancelLocked(notif)
+		} else if n.scheduleLocked(notif) {
+			isEarliest = true
+		}
 	}
 
-	// acquire the semaphore to limit the number of concurrent notifications
-	notificationSem <- struct{}{}
+	n.mutex.Unlock()
+
+	if isEarliest {
+		n.wakeDispatcher()
+	}
 
-	n.Notifier <- notif
+	return true
+}
 
+// EndSeries cancels the pending occurrences of the series and prevents the
+// occurrences being sent from scheduling another one. It returns false if
+// the series does not exist.
+func (n *NotificationScheduler) EndSeries(seriesId string) bool {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if _, exists := n.series[seriesId]; !exists {
+		return false
+	}
+
+	delete(n.series, seriesId)
+	for _, notif := range n.seriesNotificationsLocked(seriesId) {
+		if !notif.sending {
+			n.cancelLocked(notif)
+		}
+	}
+
+	return true
+}
+
+// scheduleNextOccurrence schedules the next occurrence of a recurring
+// notification that has been sent. Tokens that were reported as invalid
+// are not included in the next occurrence.
+func (n *NotificationScheduler) scheduleNextOccurrence(notif *ScheduledNotification, failed map[string]error) {
+	if notif.Recurrence == nil {
+		return
+	}
+
+	seriesId := notif.Recurrence.SeriesId
+	scheduledTime := notif.Recurrence.Next(time.Now())
+
+	n.mutex.Lock()
+
+	series, exists := n.series[seriesId]
+	if !exists {
+		n.mutex.Unlock()
+		return
+	}
+
+	next := *notif
+	if notif.MulticastMessage != nil {
+		message := *notif.MulticastMessage
+		message.Tokens = slices.DeleteFunc(slices.Clone(message.Tokens), func(token string) bool {
+			err, hasFailed := failed[token]
+			return hasFailed && isInvalidTokenError(err)
+		})
+		next.MulticastMessage = &message
+	}
+
+	if scheduledTime.IsZero() || (next.MulticastMessage != nil && len(next.MulticastMessage.Tokens) == 0) {
+		log.Default().Printf("Notification series %s has ended\n", seriesId)
+		n.forgetSeriesLocked(seriesId)
+		n.mutex.Unlock()
+		return
+	}
+
+	next.Id, _ = gonanoid.New()
+	attachNotificationId(&next)
+
+	next.ScheduledTime = scheduledTime
+	next.CompletionStatus = false
+	next.Attempts = 0
+	next.SentAt = time.Time{}
+	next.FailedTokens = nil
+	next.LastError = ""
+	next.Tags = slices.Clone(notif.Tags)
+
+	if series.paused {
+		next.cancelled = false
+		next.sending = false
+		next.queueIndex = -1
+		next.Status = notificationStatusPaused
+		n.trackLocked(&next)
+		n.mutex.Unlock()
+		return
+	}
+
+	isEarliest := n.scheduleLocked(&next)
+	n.mutex.Unlock()
+
+	if isEarliest {
+		n.wakeDispatcher()
+	}
+}
+
+// markCompleted marks the notification as sent and removes it from the pending notifications.
+func (n *NotificationScheduler) markCompleted(notif *ScheduledNotification, failed map[string]error) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
 	notif.CompletionStatus = true
+	notif.SentAt = time.Now()
+	notif.Status = notificationStatusSent
+	notif.FailedTokens = nil
+	notif.LastError = ""
 
-	// release the semaphore
-	<-notificationSem
+	for token, err := range failed {
+		notif.Status = notificationStatusFailed
+		notif.FailedTokens = append(notif.FailedTokens, token)
+		if err != nil {
+			notif.LastError = err.Error()
+		}
+	}
+
+	n.untrackLocked(notif)
+	n.recordHistoryLocked(notif)
+}
+
+// recordHistoryLocked keeps a copy of the notification in the history
+// of recent notifications.
+func (n *NotificationScheduler) recordHistoryLocked(notif *ScheduledNotification) {
+	entry := *notif
+	n.history = append(n.history, &entry)
+	if len(n.history) > maxNotificationHistory {
+		n.history = slices.Delete(n.history, 0, len(n.history)-maxNotificationHistory)
+	}
+}
+
+func (n *NotificationScheduler) setHistoryStatus(id string, status string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	for i := len(n.history) - 1; i >= 0; i-- {
+		if n.history[i].Id == id {
+			n.history[i].Status = status
+			return
+		}
+	}
+}
+
+// PendingNotifications returns a copy of the notifications that have not been sent yet.
+func (n *NotificationScheduler) PendingNotifications() []*ScheduledNotification {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	pending := make([]*ScheduledNotification, 0, len(n.Notifs))
+	for _, notif := range n.Notifs {
+		entry := *notif
+		pending = append(pending, &entry)
+	}
+
+	slices.SortFunc(pending, func(a, b *ScheduledNotification) int {
+		return a.ScheduledTime.Compare(b.ScheduledTime)
+	})
+
+	return pending
+}
+
+// RecentNotifications returns a copy of the recently sent or cancelled
+// notifications, latest first.
+func (n *NotificationScheduler) RecentNotifications() []*ScheduledNotification {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	recent := make([]*ScheduledNotification, len(n.history))
+	for idx, notif := range n.history {
+		entry := *notif
+		recent[len(n.history)-1-idx] = &entry
+	}
+
+	return recent
+}
+
+// FindNotification returns a copy of the pending or recent notification with the id.
+func (n *NotificationScheduler) FindNotification(id string) *ScheduledNotification {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if notif, exists := n.Notifs[id]; exists {
+		entry := *notif
+		return &entry
+	}
+
+	for i := len(n.history) - 1; i >= 0; i-- {
+		if n.history[i].Id == id {
+			entry := *n.history[i]
+			return &entry
+		}
+	}
+
+	return nil
+}
+
+// Resend schedules a new notification to the failed tokens of a recently
+// failed notification. Notifications which are no longer in the history
+// are looked up from the dead letters. It returns the id of the new
+// notification.
+func (n *NotificationScheduler) Resend(id string) (string, error) {
+	n.mutex.Lock()
+
+	var found *ScheduledNotification
+	for i := len(n.history) - 1; i >= 0; i-- {
+		if n.history[i].Id == id {
+			entry := *n.history[i]
+			found = &entry
+			break
+		}
+	}
+
+	n.mutex.Unlock()
+
+	if found == nil && n.LoadDeadLetter != nil {
+		found = n.LoadDeadLetter(id)
+	}
+
+	if found == nil {
+		return "", errors.New("notification not found")
+	}
+
+	if len(found.FailedTokens) == 0 {
+		return "", errors.New("notification has no failed tokens")
+	}
+
+	resend := &ScheduledNotification{
+		Message:       found.Message,
+		Transport:     found.Transport,
+		MaxAttempts:   found.MaxAttempts,
+		Tags:          slices.Clone(found.Tags),
+		Kind:          found.Kind,
+		Recipients:    slices.Clone(found.Recipients),
+		ScheduledTime: time.Now(),
+	}
+
+	if found.MulticastMessage != nil {
+		message := *found.MulticastMessage
+		message.Tokens = slices.Clone(found.FailedTokens)
+		resend.MulticastMessage = &message
+	}
+
+	return n.AddNotification(resend), nil
 }
 
 func (n *NotificationScheduler) RemoveNotification(target string) {
 	n.mutex.Lock()
 	defer n.mutex.Unlock()
 
-	delete(n.Notifs, target)
+	if notif, exists := n.Notifs[target]; exists {
+		n.cancelLocked(notif)
+	}
+}
+
+// TokenFailures returns the number of consecutive failed sends of the token.
+func (n *NotificationScheduler) TokenFailures(token string) int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.tokenFailures[token]
+}
+
+// SetTransport sets the transport used for sending the notifications
+// of the given transport name.
+func (n *NotificationScheduler) SetTransport(name string, transport PushTransport) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.Transports[name] = transport
+}
+
+// Transport returns the transport with the name, if any.
+func (n *NotificationScheduler) Transport(name string) PushTransport {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if len(name) == 0 {
+		name = transportFCM
+	}
+
+	return n.Transports[name]
+}
+
+// isUnregisteredTokenError checks if the error was caused by a token
+// that is no longer registered.
+func isUnregisteredTokenError(err error) bool {
+	var transportErr interface{ IsInvalidToken() bool }
+	if errors.As(err, &transportErr) {
+		return transportErr.IsInvalidToken()
+	}
+
+	if resp := errorutils.HTTPResponse(err); resp != nil && resp.StatusCode == http.StatusGone {
+		return true
+	}
+
+	return messaging.IsRegistrationTokenNotRegistered(err) || messaging.IsUnregistered(err)
+}
+
+// isInvalidTokenError checks if the error was caused by a token
+// that is no longer registered or is malformed.
+func isInvalidTokenError(err error) bool {
+	return isUnregisteredTokenError(err) || messaging.IsInvalidArgument(err)
+}
+
+// handleTokenResult updates the failure counter of the token based on
+// the result of the send and reports the token if it is no longer valid.
+//
+// Unregistered tokens are reported right away. Invalid argument errors
+// may also be caused by the message so they are only reported once they
+// keep happening. Other errors (e.g. an unavailable transport) say nothing
+// about the token and are not counted.
+func (n *NotificationScheduler) handleTokenResult(token string, err error) {
+	n.mutex.Lock()
+
+	if err == nil {
+		delete(n.tokenFailures, token)
+		n.mutex.Unlock()
+		return
+	}
+
+	if !isInvalidTokenError(err) {
+		n.mutex.Unlock()
+		return
+	}
+
+	n.tokenFailures[token]++
+	isInvalid := isUnregisteredTokenError(err) || n.tokenFailures[token] >= maxTokenFailures
+	if isInvalid {
+		delete(n.tokenFailures, token)
+	}
+
+	n.mutex.Unlock()
+
+	if isInvalid {
+		log.Default().Printf("Removing invalid token %s: %v\n", token, err)
+		if n.OnInvalidToken != nil {
+			n.OnInvalidToken(token)
+		}
+	}
+}
+
+// handleBatchResponse inspects the per-token responses of a multicast
+// send and returns the errors of the tokens that failed.
+func (n *NotificationScheduler) handleBatchResponse(notif *ScheduledNotification, resp *messaging.BatchResponse) map[string]error {
+	failed := map[string]error{}
+	if resp == nil {
+		return failed
+	}
+
+	tokens := notif.MulticastMessage.Tokens
+	for idx, tokenResp := range resp.Responses {
+		if idx >= len(tokens) {
+			break
+		}
+
+		if !tokenResp.Success {
+			log.Default().Printf("Error sending notification %s to %s: %v\n", notif.Id, tokens[idx], tokenResp.Error)
+			failed[tokens[idx]] = tokenResp.Error
+		}
+
+		n.handleTokenResult(tokens[idx], tokenResp.Error)
+	}
+
+	return failed
+}
+
+// send sends the notification and returns the errors of the tokens that failed.
+func (n *NotificationScheduler) send(notif *ScheduledNotification) map[string]error {
+	transport := n.Transport(notif.Transport)
+	if transport == nil {
+		err := &TransportNotConfiguredError{Transport: notif.Transport}
+		log.Default().Printf("Error sending notification to %s: %v\n", notif.Id, err)
+
+		failed := map[string]error{}
+		if notif.Message != nil {
+			failed[notif.Message.Token] = err
+		} else if notif.MulticastMessage != nil {
+			for _, token := range notif.MulticastMessage.Tokens {
+				failed[token] = err
+			}
+		}
+		return failed
+	}
+
+	if notif.Message != nil {
+		log.Default().Printf("Sending notification to %s\n", notif.Message.Token)
+		_, err := transport.Send(context.Background(), notif.Message)
+		if err != nil {
+			log.Default().Printf("Error sending notification to %s: %v\n", notif.Id, err)
+		}
+
+		if len(notif.Message.Token) != 0 {
+			n.handleTokenResult(notif.Message.Token, err)
+		}
+
+		if err != nil {
+			return map[string]error{notif.Message.Token: err}
+		}
+		return nil
+	} else if notif.MulticastMessage != nil {
+		log.Default().Printf("Sending notification to %q\n", notif.MulticastMessage.Tokens)
+		resp, err := transport.SendEachForMulticast(context.Background(), notif.MulticastMessage)
+		if err != nil {
+			log.Default().Printf("Error sending notification to %s: %v\n", notif.Id, err)
+
+			// the whole batch failed
+			if resp == nil {
+				failed := map[string]error{}
+				for _, token := range notif.MulticastMessage.Tokens {
+					failed[token] = err
+				}
+				return failed
+			}
+		}
+
+		return n.handleBatchResponse(notif, resp)
+	}
+
+	log.Default().Printf("Error sending notification to %s: no message specified\n", notif.Id)
+	return nil
+}
+
+// isRetryableError checks if the send failed due to a temporary error.
+func isRetryableError(err error) bool {
+	var transportErr interface{ IsRetryable() bool }
+	if errors.As(err, &transportErr) {
+		return transportErr.IsRetryable()
+	}
+
+	// connection failures of the transports which talk to their servers
+	// directly (e.g. APNs and UnifiedPush)
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	} else if errors.As(err, &dnsErr) && dnsErr.IsTemporary {
+		return true
+	} else if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	return messaging.IsUnavailable(err) ||
+		messaging.IsInternal(err) ||
+		messaging.IsQuotaExceeded(err) ||
+		errorutils.IsDeadlineExceeded(err)
+}
+
+// retryAfter returns the delay requested by the Retry-After header of the
+// error's response, if any.
+func retryAfter(err error) time.Duration {
+	resp := errorutils.HTTPResponse(err)
+	if resp == nil {
+		return 0
+	}
+
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date)
+	}
+
+	return 0
+}
+
+// retryDelay returns the exponential backoff with jitter of the given attempt.
+func retryDelay(attempt int) time.Duration {
+	delay := retryBaseDelay << (attempt - 1)
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	}
+
+	// use a random delay between half and the full backoff
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryFailed schedules another attempt of the notification for the tokens
+// that failed due to a temporary error. Notifications that have used up all of
+// their attempts or failed with an error that can not be retried are sent to
+// the dead letter handler instead.
+func (n *NotificationScheduler) retryFailed(notif *ScheduledNotification, failed map[string]error) {
+	tokens := []string{}
+	deadTokens := []string{}
+	delay := time.Duration(0)
+	var lastErr error
+	var deadErr error
+
+	for token, err := range failed {
+		if !isRetryableError(err) {
+			// invalid tokens are removed instead
+			if !isInvalidTokenError(err) {
+				deadTokens = append(deadTokens, token)
+				deadErr = err
+			}
+			continue
+		}
+
+		tokens = append(tokens, token)
+		lastErr = err
+		if after := retryAfter(err); after > delay {
+			delay = after
+		}
+	}
+
+	if len(deadTokens) != 0 {
+		log.Default().Printf("Giving up on notification %s: %v\n", notif.Id, deadErr)
+		n.deadLetter(notif, deadTokens, deadErr)
+	}
+
+	if len(tokens) == 0 {
+		return
+	}
+
+	maxAttempts := notif.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = defaultMaxSendAttempts
+	}
+
+	retry := n.withTokens(notif, tokens)
+	if retry.Attempts >= maxAttempts {
+		log.Default().Printf("Giving up on notification %s after %d attempts: %v\n", notif.Id, retry.Attempts, lastErr)
+		n.deadLetter(notif, tokens, lastErr)
+		return
+	}
+
+	if backoff := retryDelay(retry.Attempts); backoff > delay {
+		delay = backoff
+	}
+
+	log.Default().Printf("Retrying notification %s to %d tokens in %s\n", notif.Id, len(tokens), delay)
+	n.setHistoryStatus(notif.Id, notificationStatusRetrying)
+
+	// the next occurrence is scheduled by the original notification
+	retry.Recurrence = nil
+	retry.CompletionStatus = false
+	retry.Tags = slices.Clone(notif.Tags)
+	retry.ScheduledTime = time.Now().Add(delay)
+	n.schedule(retry)
+}
+
+// withTokens returns a copy of the notification which is only sent to the tokens.
+func (n *NotificationScheduler) withTokens(notif *ScheduledNotification, tokens []string) *ScheduledNotification {
+	n.mutex.Lock()
+	copied := *notif
+	n.mutex.Unlock()
+
+	if notif.MulticastMessage != nil {
+		message := *notif.MulticastMessage
+		message.Tokens = tokens
+		copied.MulticastMessage = &message
+	}
+
+	return &copied
+}
+
+// deadLetter gives up on sending the notification to the tokens.
+func (n *NotificationScheduler) deadLetter(notif *ScheduledNotification, tokens []string, lastErr error) {
+	n.setHistoryStatus(notif.Id, notificationStatusDead)
+	if n.OnDeadLetter != nil {
+		n.OnDeadLetter(n.withTokens(notif, tokens), lastErr)
+	}
 }
 
 func startSchedulingNotifications() (*NotificationScheduler, func()) {
-	notifier := make(chan *ScheduledNotification)
+	notifier := make(chan *ScheduledNotification, sendWorkers)
 	scheduler := NewNotificationScheduler(notifier)
 	monitorFunc := func() {
-		for notif := range notifier {
-			// send the notification
-			if notif.Message != nil {
-				log.Default().Printf("Sending notification to %s\n", notif.Message.Token)
-				_, err := scheduler.MessagingClient.Send(context.Background(), notif.Message)
-				if err != nil {
-					log.Default().Printf("Error sending notification to %s: %v\n", notif.Id, err)
-				}
-			} else if notif.MulticastMessage != nil {
-				log.Default().Printf("Sending notification to %q\n", notif.MulticastMessage.Tokens)
-				_, err := scheduler.MessagingClient.SendEachForMulticast(context.Background(), notif.MulticastMessage)
-				if err != nil {
-					log.Default().Printf("Error sending notification to %s: %v\n", notif.Id, err)
-				}
-			} else {
-				log.Default().Printf("Error sending notification to %s: no message specified\n", notif.Id)
-			}
+		wg := sync.WaitGroup{}
+		for i := 0; i < sendWorkers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for notif := range notifier {
+					if !scheduler.markSending(notif) {
+						continue
+					}
+
+					// the occurrence is sent by its series
+					if notif.Recurrence != nil && notif.Recurrence.OnDue != nil {
+						notif.Recurrence.OnDue(notif)
+						scheduler.markCompleted(notif, nil)
+						scheduler.scheduleNextOccurrence(notif, nil)
+						continue
+					}
 
-			scheduler.RemoveNotification(notif.Id)
+					// send the notification
+					failed := scheduler.send(notif)
+
+					scheduler.markCompleted(notif, failed)
+					scheduler.retryFailed(notif, failed)
+					scheduler.scheduleNextOccurrence(notif, failed)
+				}
+			}()
 		}
+
+		go scheduler.dispatch()
+		wg.Wait()
+		close(scheduler.workersDone)
 	}
 
 	return scheduler, monitorFunc
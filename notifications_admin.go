@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"golang.org/x/exp/slices"
+)
+
+// notificationView is the representation of a scheduled notification
+// returned by the admin API.
+type notificationView struct {
+	Id            string    `json:"id"`
+	Kind          string    `json:"kind"`
+	Status        string    `json:"status"`
+	Recipients    []string  `json:"recipients"`
+	Tags          []string  `json:"tags"`
+	Tokens        int       `json:"tokens"`
+	FailedTokens  []string  `json:"failed_tokens"`
+	Transport     string    `json:"transport"`
+	Series        string    `json:"series"`
+	Attempts      int       `json:"attempts"`
+	ScheduledTime time.Time `json:"scheduled_time"`
+	SentAt        time.Time `json:"sent_at"`
+	LastError     string    `json:"last_error"`
+}
+
+func newNotificationView(notif *ScheduledNotification) notificationView {
+	tokens := 0
+	if notif.MulticastMessage != nil {
+		tokens = len(notif.MulticastMessage.Tokens)
+	} else if notif.Message != nil {
+		tokens = 1
+	}
+
+	series := ""
+	if notif.Recurrence != nil {
+		series = notif.Recurrence.SeriesId
+	}
+
+	return notificationView{
+		Id:            notif.Id,
+		Kind:          notif.Kind,
+		Status:        notif.Status,
+		Recipients:    notif.Recipients,
+		Tags:          notif.Tags,
+		Tokens:        tokens,
+		FailedTokens:  notif.FailedTokens,
+		Transport:     notif.Transport,
+		Series:        series,
+		Attempts:      notif.Attempts,
+		ScheduledTime: notif.ScheduledTime,
+		SentAt:        notif.SentAt,
+		LastError:     notif.LastError,
+	}
+}
+
+// filterNotifications returns the views of the notifications matching the
+// user, room, kind and status query params (if provided).
+func filterNotifications(c echo.Context, notifs []*ScheduledNotification) []notificationView {
+	userId := c.QueryParam("user")
+	roomId := c.QueryParam("room")
+	kind := c.QueryParam("kind")
+	status := c.QueryParam("status")
+
+	views := []notificationView{}
+	for _, notif := range notifs {
+		if len(userId) != 0 && !slices.Contains(notif.Recipients, userId) {
+			continue
+		} else if len(roomId) != 0 && !slices.Contains(notif.Tags, makeRoomNotificationTag(roomId)) {
+			continue
+		} else if len(kind) != 0 && notif.Kind != kind {
+			continue
+		} else if len(status) != 0 && notif.Status != status {
+			continue
+		}
+
+		views = append(views, newNotificationView(notif))
+	}
+
+	return views
+}
+
+func bindNotificationAdminApi(e *core.ServeEvent, scheduler *NotificationScheduler) {
+	e.Router.Add("GET", "/api/admin/notifications", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, map[string]any{
+			"pending": filterNotifications(c, scheduler.PendingNotifications()),
+			"recent":  filterNotifications(c, scheduler.RecentNotifications()),
+		})
+	}, apis.RequireAdminAuth())
+
+	e.Router.Add("POST", "/api/admin/notifications/:id/cancel", func(c echo.Context) error {
+		if !scheduler.Cancel(c.PathParam("id")) {
+			return apis.NewNotFoundError("pending notification not found", nil)
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"message": "ok",
+		})
+	}, apis.RequireAdminAuth())
+
+	e.Router.Add("POST", "/api/admin/notifications/:id/resend", func(c echo.Context) error {
+		id, err := scheduler.Resend(c.PathParam("id"))
+		if err != nil {
+			return apis.NewBadRequestError(err.Error(), nil)
+		}
+
+		return c.JSON(http.StatusOK, map[string]string{
+			"id": id,
+		})
+	}, apis.RequireAdminAuth())
+}
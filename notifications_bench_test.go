@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"runtime"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// benchPendingNotifications is the number of notifications
+// waiting in the queue during the benchmarks
+const benchPendingNotifications = 100_000
+
+func newBenchNotification(idx int, scheduledTime time.Time) *ScheduledNotification {
+	return &ScheduledNotification{
+		ScheduledTime: scheduledTime,
+		Kind:          chatMessageNotification.Name,
+		Tags:          []string{makeChatNotificationTag(fmt.Sprintf("gc_%d", idx%1000))},
+		Message: &messaging.Message{
+			Token: fmt.Sprintf("token-%d", idx),
+			Data:  map[string]string{"index": fmt.Sprint(idx)},
+		},
+	}
+}
+
+// newBenchScheduler returns a scheduler without workers holding the
+// pending notifications, which are spread over the next day.
+func newBenchScheduler(b *testing.B, pending int) *NotificationScheduler {
+	b.Helper()
+
+	scheduler := NewNotificationScheduler(make(chan *ScheduledNotification))
+	fillBenchScheduler(scheduler, pending)
+	return scheduler
+}
+
+func fillBenchScheduler(scheduler *NotificationScheduler, pending int) {
+	now := time.Now()
+	for i := 0; i < pending; i++ {
+		offset := time.Duration(i*7919%pending) * (24 * time.Hour / time.Duration(pending))
+		scheduler.AddNotification(newBenchNotification(i, now.Add(time.Hour+offset)))
+	}
+}
+
+// signalingTransport reports the tokens sent through the RecordingTransport.
+type signalingTransport struct {
+	*RecordingTransport
+	sent chan string
+}
+
+func (t *signalingTransport) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	id, err := t.RecordingTransport.Send(ctx, message)
+	t.sent <- message.Token
+	return id, err
+}
+
+// discardLogs silences the logs of the sends for the rest of the benchmark.
+func discardLogs(b *testing.B) {
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(output) })
+}
+
+func BenchmarkAddNotification(b *testing.B) {
+	scheduler := newBenchScheduler(b, benchPendingNotifications)
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		scheduler.AddNotification(newBenchNotification(i, now.Add(time.Duration(i%86400)*time.Second)))
+	}
+}
+
+func BenchmarkCancelByTag(b *testing.B) {
+	scheduler := newBenchScheduler(b, benchPendingNotifications)
+	now := time.Now()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		notif := newBenchNotification(i, now.Add(time.Minute))
+		notif.Tags = []string{"bench"}
+		scheduler.AddNotification(notif)
+		b.StartTimer()
+
+		if cancelled := scheduler.CancelByTag("bench"); cancelled != 1 {
+			b.Fatalf("expected 1 cancelled notification, got %d", cancelled)
+		}
+	}
+}
+
+func BenchmarkPopDue(b *testing.B) {
+	scheduler := newBenchScheduler(b, benchPendingNotifications)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		now := time.Now()
+		scheduler.AddNotification(newBenchNotification(i, now.Add(-time.Second)))
+
+		if due, _ := scheduler.popDue(now); len(due) != 1 {
+			b.Fatalf("expected 1 due notification, got %d", len(due))
+		}
+	}
+}
+
+func BenchmarkPendingNotificationsHeap(b *testing.B) {
+	var before, after runtime.MemStats
+	heapBytes := uint64(0)
+
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		scheduler := newBenchScheduler(b, benchPendingNotifications)
+
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		runtime.KeepAlive(scheduler)
+
+		if after.HeapAlloc > before.HeapAlloc {
+			heapBytes += after.HeapAlloc - before.HeapAlloc
+		}
+	}
+
+	b.ReportMetric(float64(heapBytes)/float64(b.N), "heap-bytes")
+	b.ReportMetric(float64(heapBytes)/float64(b.N)/benchPendingNotifications, "heap-bytes/notification")
+}
+
+func BenchmarkDueToSendLatency(b *testing.B) {
+	discardLogs(b)
+
+	scheduler, monitor := startSchedulingNotifications()
+	transport := &signalingTransport{RecordingTransport: NewRecordingTransport(), sent: make(chan string, 1)}
+	scheduler.SetTransport(transportFCM, transport)
+	fillBenchScheduler(scheduler, benchPendingNotifications)
+	go monitor()
+
+	b.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		scheduler.Shutdown(ctx)
+	})
+
+	latency := time.Duration(0)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		notif := newBenchNotification(benchPendingNotifications+i, time.Now())
+		scheduler.AddNotification(notif)
+
+		<-transport.sent
+		latency += time.Since(notif.ScheduledTime)
+	}
+
+	b.StopTimer()
+	b.ReportMetric(float64(latency.Nanoseconds())/float64(b.N), "ns/send")
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	"golang.org/x/exp/slices"
+)
+
+// testScheduler is a running scheduler which sends its notifications
+// through a RecordingTransport.
+type testScheduler struct {
+	*NotificationScheduler
+	transport *RecordingTransport
+
+	mutex         sync.Mutex
+	deadLetters   []*ScheduledNotification
+	invalidTokens []string
+}
+
+func newTestScheduler(t *testing.T) *testScheduler {
+	t.Helper()
+
+	baseDelay := retryBaseDelay
+	retryBaseDelay = 20 * time.Millisecond
+	t.Cleanup(func() { retryBaseDelay = baseDelay })
+
+	scheduler, monitor := startSchedulingNotifications()
+	ts := &testScheduler{NotificationScheduler: scheduler, transport: NewRecordingTransport()}
+	scheduler.SetTransport(transportFCM, ts.transport)
+
+	scheduler.OnDeadLetter = func(notif *ScheduledNotification, lastErr error) {
+		ts.mutex.Lock()
+		defer ts.mutex.Unlock()
+		ts.deadLetters = append(ts.deadLetters, notif)
+	}
+
+	scheduler.OnInvalidToken = func(token string) {
+		ts.mutex.Lock()
+		defer ts.mutex.Unlock()
+		ts.invalidTokens = append(ts.invalidTokens, token)
+	}
+
+	go monitor()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		scheduler.Shutdown(ctx)
+	})
+
+	return ts
+}
+
+// setFailing makes the sends to the token fail with the error, or succeed if it is nil.
+func (ts *testScheduler) setFailing(token string, err error) {
+	ts.transport.mutex.Lock()
+	defer ts.transport.mutex.Unlock()
+
+	if err == nil {
+		delete(ts.transport.FailingTokens, token)
+	} else {
+		ts.transport.FailingTokens[token] = err
+	}
+}
+
+func (ts *testScheduler) DeadLetters() []*ScheduledNotification {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return slices.Clone(ts.deadLetters)
+}
+
+func (ts *testScheduler) InvalidTokens() []string {
+	ts.mutex.Lock()
+	defer ts.mutex.Unlock()
+	return slices.Clone(ts.invalidTokens)
+}
+
+// waitFor fails the test if the condition is not met within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func newTestNotification(tokens ...string) *ScheduledNotification {
+	return &ScheduledNotification{
+		ScheduledTime:    time.Now(),
+		Kind:             chatMessageNotification.Name,
+		MulticastMessage: &messaging.MulticastMessage{Tokens: tokens},
+	}
+}
+
+func TestRetryOnlyFailedTokens(t *testing.T) {
+	scheduler := newTestScheduler(t)
+	scheduler.setFailing("b", &UnifiedPushError{Status: 503})
+
+	scheduler.AddNotification(newTestNotification("a", "b"))
+
+	waitFor(t, "the send to a", func() bool { return len(scheduler.transport.SentMessages("a")) == 1 })
+	scheduler.setFailing("b", nil)
+	waitFor(t, "the retry to b", func() bool { return len(scheduler.transport.SentMessages("b")) == 1 })
+
+	if sent := len(scheduler.transport.SentMessages("a")); sent != 1 {
+		t.Fatalf("expected a to be sent once, got %d", sent)
+	}
+
+	if deadLetters := scheduler.DeadLetters(); len(deadLetters) != 0 {
+		t.Fatalf("expected no dead letters, got %d", len(deadLetters))
+	}
+}
+
+func TestPruneInvalidTokens(t *testing.T) {
+	scheduler := newTestScheduler(t)
+	scheduler.setFailing("gone", &UnifiedPushError{Status: 410})
+	scheduler.setFailing("rejected", &UnifiedPushError{Status: 400})
+
+	scheduler.AddNotification(newTestNotification("a", "gone", "rejected"))
+
+	waitFor(t, "the invalid token", func() bool { return len(scheduler.InvalidTokens()) == 1 })
+	waitFor(t, "the dead letter", func() bool { return len(scheduler.DeadLetters()) == 1 })
+
+	if invalidTokens := scheduler.InvalidTokens(); invalidTokens[0] != "gone" {
+		t.Fatalf("expected gone to be pruned, got %q", invalidTokens)
+	}
+
+	// invalid tokens are removed instead of being dead lettered
+	if tokens := scheduler.DeadLetters()[0].MulticastMessage.Tokens; !slices.Equal(tokens, []string{"rejected"}) {
+		t.Fatalf("expected only rejected to be dead lettered, got %q", tokens)
+	}
+
+	// errors which say nothing about the token are not counted
+	if failures := scheduler.TokenFailures("rejected"); failures != 0 {
+		t.Fatalf("expected no failures of rejected, got %d", failures)
+	}
+
+	if failures := scheduler.TokenFailures("gone"); failures != 0 {
+		t.Fatalf("expected the failures of gone to be reset, got %d", failures)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	t.Run("after the last attempt", func(t *testing.T) {
+		scheduler := newTestScheduler(t)
+		scheduler.setFailing("b", &UnifiedPushError{Status: 503})
+
+		notif := newTestNotification("a", "b")
+		notif.MaxAttempts = 3
+		id := scheduler.AddNotification(notif)
+
+		waitFor(t, "the dead letter", func() bool { return len(scheduler.DeadLetters()) == 1 })
+
+		deadLetter := scheduler.DeadLetters()[0]
+		if deadLetter.Id != id {
+			t.Fatalf("expected the dead letter of %s, got %s", id, deadLetter.Id)
+		} else if deadLetter.Attempts != 3 {
+			t.Fatalf("expected 3 attempts, got %d", deadLetter.Attempts)
+		} else if !slices.Equal(deadLetter.MulticastMessage.Tokens, []string{"b"}) {
+			t.Fatalf("expected only b to be dead lettered, got %q", deadLetter.MulticastMessage.Tokens)
+		}
+
+		if sent := len(scheduler.transport.SentMessages("a")); sent != 1 {
+			t.Fatalf("expected a to be sent once, got %d", sent)
+		}
+
+		if found := scheduler.FindNotification(id); found == nil || found.Status != notificationStatusDead {
+			t.Fatalf("expected the notification to be dead, got %+v", found)
+		}
+	})
+
+	t.Run("without retrying", func(t *testing.T) {
+		scheduler := newTestScheduler(t)
+		scheduler.setFailing("a", &UnifiedPushError{Status: 400})
+
+		scheduler.AddNotification(newTestNotification("a"))
+
+		waitFor(t, "the dead letter", func() bool { return len(scheduler.DeadLetters()) == 1 })
+
+		if attempts := scheduler.DeadLetters()[0].Attempts; attempts != 1 {
+			t.Fatalf("expected 1 attempt, got %d", attempts)
+		}
+	})
+
+	t.Run("without a transport", func(t *testing.T) {
+		scheduler := newTestScheduler(t)
+
+		notif := newTestNotification("a")
+		notif.Transport = transportUnifiedPush
+		scheduler.AddNotification(notif)
+
+		waitFor(t, "the dead letter", func() bool { return len(scheduler.DeadLetters()) == 1 })
+	})
+}
+
+func TestCancel(t *testing.T) {
+	scheduler := newTestScheduler(t)
+
+	notif := newTestNotification("a")
+	notif.ScheduledTime = time.Now().Add(50 * time.Millisecond)
+	id := scheduler.AddNotification(notif)
+
+	if !scheduler.Cancel(id) {
+		t.Fatal("expected the notification to be cancelled")
+	} else if scheduler.Cancel(id) {
+		t.Fatal("expected the notification to be cancelled only once")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if sent := len(scheduler.transport.SentMessages("a")); sent != 0 {
+		t.Fatalf("expected the cancelled notification not to be sent, got %d", sent)
+	}
+}
+
+func TestCancelByTag(t *testing.T) {
+	scheduler := newTestScheduler(t)
+
+	for _, token := range []string{"a", "b", "c"} {
+		notif := newTestNotification(token)
+		notif.ScheduledTime = time.Now().Add(50 * time.Millisecond)
+		if token != "c" {
+			notif.Tags = []string{"room"}
+		}
+		scheduler.AddNotification(notif)
+	}
+
+	if cancelled := scheduler.CancelByTag("room"); cancelled != 2 {
+		t.Fatalf("expected 2 cancelled notifications, got %d", cancelled)
+	} else if cancelled := scheduler.CancelByTag("room"); cancelled != 0 {
+		t.Fatalf("expected no cancelled notifications, got %d", cancelled)
+	}
+
+	waitFor(t, "the untagged notification", func() bool { return len(scheduler.transport.SentMessages("c")) == 1 })
+	for _, token := range []string{"a", "b"} {
+		if sent := len(scheduler.transport.SentMessages(token)); sent != 0 {
+			t.Fatalf("expected the tagged notification to %s not to be sent, got %d", token, sent)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	scheduler := newTestScheduler(t)
+
+	add := func(tokens ...string) string {
+		notif := newTestNotification(tokens...)
+		notif.ScheduledTime = time.Now().Add(time.Hour)
+		notif.DedupeKey = "message"
+		return scheduler.AddNotification(notif)
+	}
+
+	if id := add("a", "b"); len(id) == 0 {
+		t.Fatal("expected the first notification to be scheduled")
+	}
+
+	if id := add("a", "b"); len(id) != 0 {
+		t.Fatal("expected the duplicate notification to be dropped")
+	}
+
+	if !scheduler.IsDuplicate("message", "a") {
+		t.Fatal("expected a to be a duplicate")
+	} else if scheduler.IsDuplicate("message", "c") || scheduler.IsDuplicate("other", "a") {
+		t.Fatal("expected only the scheduled tokens of the key to be duplicates")
+	}
+
+	id := add("b", "c")
+	if found := scheduler.FindNotification(id); found == nil || !slices.Equal(found.MulticastMessage.Tokens, []string{"c"}) {
+		t.Fatalf("expected only the new token to be scheduled, got %+v", found)
+	}
+
+	scheduler.ForgetDedupeKey("message")
+	if id := add("a"); len(id) == 0 {
+		t.Fatal("expected the notification to be scheduled after forgetting the key")
+	}
+}
+
+func TestRecurrence(t *testing.T) {
+	scheduler := newTestScheduler(t)
+	scheduler.setFailing("gone", &UnifiedPushError{Status: 410})
+
+	recurrence, err := NewRecurrence("series", "0 9 * * *", "Asia/Manila", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notif := newTestNotification("a", "gone")
+	notif.Recurrence = recurrence
+	id := scheduler.AddNotification(notif)
+
+	waitFor(t, "the next occurrence", func() bool {
+		pending := scheduler.PendingNotifications()
+		return len(pending) == 1 && pending[0].Id != id
+	})
+
+	next := scheduler.PendingNotifications()[0]
+	if next.Recurrence.SeriesId != "series" {
+		t.Fatalf("expected the next occurrence of the series, got %s", next.Recurrence.SeriesId)
+	} else if local := next.ScheduledTime.In(recurrence.Location); local.Hour() != 9 || local.Minute() != 0 {
+		t.Fatalf("expected the next occurrence at 9 AM, got %s", local)
+	} else if !slices.Equal(next.MulticastMessage.Tokens, []string{"a"}) {
+		t.Fatalf("expected the invalid token to be dropped, got %q", next.MulticastMessage.Tokens)
+	}
+
+	if !scheduler.EndSeries("series") {
+		t.Fatal("expected the series to end")
+	} else if pending := scheduler.PendingNotifications(); len(pending) != 0 {
+		t.Fatalf("expected no pending occurrences, got %d", len(pending))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// shutdownTimeout is how long the scheduler is given to
+// send the due notifications before the app exits. It must stay
+// below the kill_timeout in fly.toml.
+var shutdownTimeout = 10 * time.Second
+
+// storePendingNotifications saves the notifications that were still pending
+// when the scheduler shut down so that they can be restored on the next start.
+//
+// Recurring notifications are not saved since they are scheduled
+// again from their notification_schedules record.
+func storePendingNotifications(dao *daos.Dao, notifs []*ScheduledNotification) error {
+	collection, err := dao.FindCollectionByNameOrId("pending_notifications")
+	if err != nil {
+		return err
+	}
+
+	stored := 0
+	defer func() {
+		if stored != 0 {
+			log.Printf("Stored %d pending notifications\n", stored)
+		}
+	}()
+
+	for _, notif := range notifs {
+		if notif.Recurrence != nil {
+			continue
+		}
+
+		record := models.NewRecord(collection)
+		record.Set("notification_id", notif.Id)
+		record.Set("kind", notif.Kind)
+		record.Set("recipients", notif.Recipients)
+		record.Set("tags", notif.Tags)
+		record.Set("transport", notif.Transport)
+		record.Set("attempts", notif.Attempts)
+		record.Set("max_attempts", notif.MaxAttempts)
+		record.Set("scheduled_time", notif.ScheduledTime)
+
+		if notif.Message != nil {
+			record.Set("message", notif.Message)
+		} else if notif.MulticastMessage != nil {
+			record.Set("multicast_message", notif.MulticastMessage)
+		}
+
+		if err := dao.SaveRecord(record); err != nil {
+			return err
+		}
+		stored++
+	}
+
+	return nil
+}
+
+// restorePendingNotifications schedules the notifications saved on the last
+// shutdown and removes them from the collection. Notifications which have
+// outlived the TTL of their kind are dropped.
+func restorePendingNotifications(dao *daos.Dao, scheduler *NotificationScheduler) error {
+	records, err := dao.FindRecordsByFilter("pending_notifications", "id!=''", "scheduled_time", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err := dao.DeleteRecord(record); err != nil {
+			return err
+		}
+
+		notif := &ScheduledNotification{
+			Id:            record.GetString("notification_id"),
+			Kind:          record.GetString("kind"),
+			Recipients:    record.GetStringSlice("recipients"),
+			Tags:          record.GetStringSlice("tags"),
+			Transport:     record.GetString("transport"),
+			Attempts:      record.GetInt("attempts"),
+			MaxAttempts:   record.GetInt("max_attempts"),
+			ScheduledTime: record.GetDateTime("scheduled_time").Time(),
+		}
+
+		if kind, err := findNotificationKind(notif.Kind); err == nil && kind.TTL > 0 && time.Since(notif.ScheduledTime) > kind.TTL {
+			log.Printf("Dropping expired %s notification %s\n", notif.Kind, notif.Id)
+			continue
+		}
+
+		if err := unmarshalOptionalJSONField(record, "message", &notif.Message); err != nil {
+			log.Printf("Error restoring notification %s: %v\n", notif.Id, err)
+			continue
+		}
+
+		if err := unmarshalOptionalJSONField(record, "multicast_message", &notif.MulticastMessage); err != nil {
+			log.Printf("Error restoring notification %s: %v\n", notif.Id, err)
+			continue
+		}
+
+		if notif.Message == nil && notif.MulticastMessage == nil {
+			log.Printf("Error restoring notification %s: no message specified\n", notif.Id)
+			continue
+		}
+
+		scheduler.RestoreNotification(notif)
+	}
+
+	if len(records) != 0 {
+		log.Printf("Restored %d pending notifications\n", len(records))
+	}
+
+	return nil
+}
+
+// unmarshalOptionalJSONField unmarshals the JSON field of the record into the
+// result if the field is set.
+func unmarshalOptionalJSONField(record *models.Record, key string, result any) error {
+	if len(record.GetString(key)) == 0 {
+		return nil
+	}
+	return record.UnmarshalJSONField(key, result)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"golang.org/x/exp/slices"
+)
+
+// platforms of the push tokens. each platform receives the payload shape that suits it.
+const (
+	// platformNative are FCM tokens of the mobile apps whose platform is not known.
+	// they receive both the Android and APNs payloads.
+	platformNative  = ""
+	platformAndroid = "android"
+	platformIOS     = "ios"
+	platformWeb     = "web"
+
+	// platformVoIP are APNs VoIP tokens which are sent directly to APNs.
+	platformVoIP = "ios_voip"
+)
+
+// pushTarget is a push token along with the info needed to render its payload.
+type pushTarget struct {
+	UserId    string
+	Token     string
+	Platform  string
+	Transport string
+	Locale    string
+	Timezone  string
+
+	// VoIPToken is the APNs VoIP token of the device, if any. Kinds
+	// delivered as VoIP pushes are sent to it instead of the token.
+	VoIPToken string
+
+	// Badge is the number of unread messages of the user
+	Badge int
+}
+
+// pushTargetGroup is a set of targets that can share the same multicast message.
+type pushTargetGroup struct {
+	Locale    string
+	Platform  string
+	Transport string
+	Timezone  string
+	Badge     int
+}
+
+// userPushTargets returns the legacy push targets registered on the user record.
+func userPushTargets(user *models.Record) []pushTarget {
+	locale := normalizeLocale(user.GetString("locale"))
+	timezone := user.GetString("timezone")
+	targets := []pushTarget{}
+
+	for _, token := range user.GetStringSlice("fcm_tokens") {
+		targets = append(targets, pushTarget{UserId: user.Id, Token: token, Platform: platformNative, Transport: transportFCM, Locale: locale, Timezone: timezone})
+	}
+
+	for _, token := range user.GetStringSlice("web_push_tokens") {
+		targets = append(targets, pushTarget{UserId: user.Id, Token: token, Platform: platformWeb, Transport: transportFCM, Locale: locale, Timezone: timezone})
+	}
+
+	for _, token := range user.GetStringSlice("apns_voip_tokens") {
+		targets = append(targets, pushTarget{UserId: user.Id, Token: token, Platform: platformVoIP, Transport: transportAPNSVoIP, Locale: locale, Timezone: timezone})
+	}
+
+	return targets
+}
+
+// pushTokenFields are the user fields where push tokens are stored.
+var pushTokenFields = []string{"fcm_tokens", "web_push_tokens", "apns_voip_tokens"}
+
+// removePushToken removes the token from whichever device or user owns it.
+func removePushToken(dao *daos.Dao, token string) error {
+	if err := removeDeviceToken(dao, token); err != nil {
+		return err
+	}
+
+	filters := make([]string, len(pushTokenFields))
+	for idx, field := range pushTokenFields {
+		filters[idx] = field + "~{:token}"
+	}
+
+	owners, err := dao.FindRecordsByFilter("users", strings.Join(filters, " || "), "", 0, 0, dbx.Params{"token": token})
+	if err != nil {
+		return err
+	}
+
+	for _, owner := range owners {
+		for _, field := range pushTokenFields {
+			tokens := owner.GetStringSlice(field)
+			if idx := slices.Index(tokens, token); idx != -1 {
+				owner.Set(field, slices.Delete(tokens, idx, idx+1))
+			}
+		}
+
+		if err := dao.SaveRecord(owner); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// groupPushTargets groups the targets by their locale, platform and
+// transport. Targets are also grouped by their timezone if byTimezone is set.
+//
+// When VoIP pushes can be sent, devices with a VoIP token only receive the
+// kinds delivered as VoIP pushes (e.g. incoming calls) through it, and every
+// other kind through their token. Otherwise they are rung through their token.
+func groupPushTargets(scheduler *NotificationScheduler, kind *NotificationKind, targets []pushTarget, byTimezone bool) map[pushTargetGroup][]pushTarget {
+	sendsVoIP := kind.VoIP && scheduler.Transport(transportAPNSVoIP) != nil
+
+	// users without a registered device who have VoIP tokens are only rung
+	// through them, since their FCM tokens would also show an alert
+	hasLegacyVoIP := map[string]bool{}
+	if sendsVoIP {
+		for _, target := range targets {
+			if target.Platform == platformVoIP {
+				hasLegacyVoIP[target.UserId] = true
+			}
+		}
+	}
+
+	groups := map[pushTargetGroup][]pushTarget{}
+	for _, target := range targets {
+		if sendsVoIP && len(target.VoIPToken) != 0 {
+			target.Token = target.VoIPToken
+			target.Platform = platformVoIP
+			target.Transport = transportAPNSVoIP
+		} else if sendsVoIP && target.Platform == platformNative && hasLegacyVoIP[target.UserId] {
+			continue
+		}
+
+		group := pushTargetGroup{
+			Locale:    normalizeLocale(target.Locale),
+			Platform:  target.Platform,
+			Transport: target.Transport,
+			Badge:     target.Badge,
+		}
+		if byTimezone {
+			group.Timezone = target.Timezone
+		}
+		groups[group] = append(groups[group], target)
+	}
+	return groups
+}
+
+// scheduleNotification schedules the notification to the targets. A multicast
+// message is built for each locale and platform of the targets. Targets which
+// have been scheduled a notification with the same dedupe key (if not empty)
+// within the dedupe window are skipped.
+//
+// It returns the ids of the scheduled notifications.
+func scheduleNotification(scheduler *NotificationScheduler, params NotificationParams, targets []pushTarget, scheduledTime time.Time, dedupeKey string, tags ...string) []string {
+	kind, err := findNotificationKind(params.Kind())
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	// duplicates are dropped before the rate limit so that they are not counted
+	if len(dedupeKey) != 0 {
+		targets = slices.DeleteFunc(targets, func(target pushTarget) bool {
+			return scheduler.IsDuplicate(dedupeKey, target.Token) && (len(target.VoIPToken) == 0 || scheduler.IsDuplicate(dedupeKey, target.VoIPToken))
+		})
+	}
+
+	if !kind.Unlimited {
+		targets = limitPushTargets(kind.Name, targets)
+	}
+
+	notifs, err := buildGroupNotifications(scheduler, params, groupPushTargets(scheduler, kind, targets, false))
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+
+	ids := []string{}
+	for _, notif := range notifs {
+		notif.ScheduledTime = scheduledTime
+		notif.DedupeKey = dedupeKey
+		notif.Tags = tags
+		if id := scheduler.AddNotification(notif); len(id) != 0 {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+// limitPushTargets removes the targets of the recipients who have
+// received too many notifications recently.
+func limitPushTargets(kind string, targets []pushTarget) []pushTarget {
+	allowed := map[string]bool{}
+	limited := []pushTarget{}
+
+	for _, target := range targets {
+		isAllowed, checked := allowed[target.UserId]
+		if !checked {
+			var retryAfter time.Duration
+			isAllowed, retryAfter = pushRateLimiter.Allow(target.UserId)
+			allowed[target.UserId] = isAllowed
+
+			if !isAllowed {
+				log.Printf("Rate limited %s notification to %s (retry in %s)\n", kind, target.UserId, retryAfter.Round(time.Second))
+			}
+		}
+
+		if isAllowed {
+			limited = append(limited, target)
+		}
+	}
+
+	return limited
+}
+
+// scheduleRecurringNotification schedules a series of notifications which
+// repeats according to the rule (a cron expression or an RRULE) until the
+// given time (if not zero). The rule is evaluated in each of the timezones.
+//
+// The targets are resolved when each occurrence is due so that the series
+// follows the recipients as they change. Only the targets in the timezone
+// of the occurrence are notified.
+func scheduleRecurringNotification(scheduler *NotificationScheduler, seriesId string, params NotificationParams, timezones []string, resolveTargets func() []pushTarget, rule string, until time.Time, tags ...string) error {
+	kind, err := findNotificationKind(params.Kind())
+	if err != nil {
+		return err
+	}
+
+	locations := map[string]bool{}
+	for _, timezone := range timezones {
+		location := loadRecurrenceLocation(timezone).String()
+		if locations[location] {
+			continue
+		}
+		locations[location] = true
+
+		recurrence, err := NewRecurrence(seriesId, rule, location, until)
+		if err != nil {
+			return err
+		}
+
+		recurrence.OnDue = func(occurrence *ScheduledNotification) {
+			targets := slices.DeleteFunc(resolveTargets(), func(target pushTarget) bool {
+				return loadRecurrenceLocation(target.Timezone).String() != location
+			})
+			scheduleNotification(scheduler, params, targets, time.Now(), "", occurrence.Tags...)
+		}
+
+		occurrence := &ScheduledNotification{
+			Kind:          kind.Name,
+			ScheduledTime: recurrence.Next(time.Now()),
+			Recurrence:    recurrence,
+			Tags:          tags,
+		}
+		if occurrence.ScheduledTime.IsZero() {
+			continue
+		}
+
+		scheduler.AddNotification(occurrence)
+	}
+
+	return nil
+}
+
+// buildGroupNotifications builds the notification of each group of targets.
+// Groups whose transport is not configured are skipped.
+func buildGroupNotifications(scheduler *NotificationScheduler, params NotificationParams, groups map[pushTargetGroup][]pushTarget) (map[pushTargetGroup]*ScheduledNotification, error) {
+	kind, err := findNotificationKind(params.Kind())
+	if err != nil {
+		return nil, err
+	}
+
+	notifs := map[pushTargetGroup]*ScheduledNotification{}
+	for group, groupTargets := range groups {
+		if len(groupTargets) == 0 {
+			continue
+		}
+
+		if group.Platform == platformVoIP && !kind.VoIP {
+			continue
+		} else if scheduler.Transport(group.Transport) == nil {
+			continue
+		}
+
+		tokens := make([]string, len(groupTargets))
+		recipients := []string{}
+		for idx, target := range groupTargets {
+			tokens[idx] = target.Token
+			if !slices.Contains(recipients, target.UserId) {
+				recipients = append(recipients, target.UserId)
+			}
+		}
+
+		message, err := kind.Build(params, group.Locale, group.Platform, group.Badge, tokens)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		notifs[group] = &ScheduledNotification{
+			MulticastMessage: message,
+			Transport:        group.Transport,
+			Kind:             kind.Name,
+			Recipients:       recipients,
+		}
+	}
+
+	return notifs, nil
+}
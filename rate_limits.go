@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// rateLimiter allows up to a number of hits per key within a sliding window.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	limit     int
+	window    time.Duration
+	hits      map[string][]time.Time
+	lastPrune time.Time
+}
+
+// newRateLimiter creates a rate limiter. Limits of zero or less disable the limiter.
+func newRateLimiter(limit int, window time.Duration) *rateLimiter {
+	return &rateLimiter{
+		limit:  limit,
+		window: window,
+		hits:   map[string][]time.Time{},
+	}
+}
+
+// newRateLimiterFromEnv creates a rate limiter configured by the env
+// variable in the form of "<limit>/<window>" (e.g. "5/1h"). The defaults
+// are used if the variable is not set or is invalid.
+func newRateLimiterFromEnv(name string, defaultLimit int, defaultWindow time.Duration) *rateLimiter {
+	value, exists := os.LookupEnv(name)
+	if !exists {
+		return newRateLimiter(defaultLimit, defaultWindow)
+	}
+
+	limit, window, err := parseRateLimit(value)
+	if err != nil {
+		log.Printf("Invalid %s: %v. Using %d/%s instead.\n", name, err, defaultLimit, defaultWindow)
+		return newRateLimiter(defaultLimit, defaultWindow)
+	}
+
+	return newRateLimiter(limit, window)
+}
+
+func parseRateLimit(value string) (int, time.Duration, error) {
+	rawLimit, rawWindow, found := strings.Cut(value, "/")
+	if !found {
+		return 0, 0, fmt.Errorf("expected <limit>/<window>, got %q", value)
+	}
+
+	limit, err := strconv.Atoi(strings.TrimSpace(rawLimit))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	window, err := time.ParseDuration(strings.TrimSpace(rawWindow))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return limit, window, nil
+}
+
+// Allow records a hit for the key if it is within the limit. Otherwise, it
+// returns false along with how long until the key is allowed again.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	if l.limit <= 0 {
+		return true, 0
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastPrune) >= l.window {
+		l.pruneLocked(now)
+	}
+
+	hits := l.hits[key]
+	for len(hits) != 0 && !hits[0].Add(l.window).After(now) {
+		hits = hits[1:]
+	}
+
+	if len(hits) >= l.limit {
+		l.hits[key] = hits
+		return false, hits[0].Add(l.window).Sub(now)
+	}
+
+	l.hits[key] = append(hits, now)
+	return true, 0
+}
+
+// pruneLocked forgets the keys whose hits are all outside of the window.
+func (l *rateLimiter) pruneLocked(now time.Time) {
+	for key, hits := range l.hits {
+		if len(hits) == 0 || !hits[len(hits)-1].Add(l.window).After(now) {
+			delete(l.hits, key)
+		}
+	}
+	l.lastPrune = now
+}
+
+// callRateLimiter limits the calls started by a caller in each chat
+var callRateLimiter = newRateLimiterFromEnv("CALL_RATE_LIMIT", 5, time.Hour)
+
+// pushRateLimiter limits the notifications received by each recipient
+var pushRateLimiter = newRateLimiterFromEnv("PUSH_RATE_LIMIT", 10, time.Minute)
+
+// newRateLimitError returns a 429 error and sets the Retry-After header
+// of the response to the seconds until the request is allowed again.
+func newRateLimitError(c echo.Context, message string, retryAfter time.Duration) *apis.ApiError {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+
+	err := apis.NewApiError(http.StatusTooManyRequests, message, nil)
+	err.Data = map[string]any{
+		"retry_after": seconds,
+	}
+	return err
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"golang.org/x/exp/slices"
+)
+
+// the read state of a user in a chat is stored in the chat_read_states collection:
+//
+//   - user: the user who has read the chat
+//   - chat: the chat identifier (e.g. "ds:<id>")
+//   - unread: the number of messages the user has not read
+//   - last_read_message: the id of the last message read by the user
+//   - last_read_at: when the last message read by the user was sent
+
+type markReadRequest struct {
+	MessageId string `json:"message_id" form:"message_id"`
+}
+
+// findReadState returns the read state of the user in the chat, or a new one if the
+// user has not read the chat yet.
+func findReadState(dao *daos.Dao, chatIdentifier string, userId string) (*models.Record, error) {
+	readState, err := dao.FindFirstRecordByFilter("chat_read_states", "chat={:chat} && user={:user}", dbx.Params{
+		"chat": chatIdentifier,
+		"user": userId,
+	})
+	if err == nil {
+		return readState, nil
+	}
+
+	collection, err := dao.FindCollectionByNameOrId("chat_read_states")
+	if err != nil {
+		return nil, err
+	}
+
+	readState = models.NewRecord(collection)
+	readState.Set("chat", chatIdentifier)
+	readState.Set("user", userId)
+	readState.Set("unread", 0)
+	return readState, nil
+}
+
+// findReadCursor returns the message of the chat with the id, or the latest
+// message of the chat if no id is given. It returns nil if the chat has no
+// messages yet.
+func findReadCursor(dao *daos.Dao, kind *ChatKind, chatId string, messageId string) (*models.Record, error) {
+	if len(messageId) != 0 {
+		return dao.FindFirstRecordByFilter(kind.MessageCollection, "id={:id} && chat={:chat}", dbx.Params{
+			"id":   messageId,
+			"chat": chatId,
+		})
+	}
+
+	messages, err := dao.FindRecordsByFilter(kind.MessageCollection, "chat={:chat}", "-created", 1, 0, dbx.Params{
+		"chat": chatId,
+	})
+	if err != nil || len(messages) == 0 {
+		return nil, err
+	}
+
+	return messages[0], nil
+}
+
+// markChatRead moves the read cursor of the user in the chat to the message,
+// or to the latest message if no id is given. The unread count is the number
+// of messages of the other members that were sent after the cursor.
+func markChatRead(dao *daos.Dao, kind *ChatKind, chatId string, userId string, messageId string) (*models.Record, error) {
+	cursor, err := findReadCursor(dao, kind, chatId, messageId)
+	if err != nil {
+		return nil, err
+	}
+
+	readState, err := findReadState(dao, kind.Identifier(chatId), userId)
+	if err != nil {
+		return nil, err
+	}
+
+	unread := 0
+	if cursor != nil {
+		err := dao.DB().
+			Select("count(*)").
+			From(kind.MessageCollection).
+			Where(dbx.HashExp{"chat": chatId}).
+			AndWhere(dbx.NewExp("[[created]] > {:created} AND [[sender]] != {:user}", dbx.Params{
+				"created": cursor.GetString("created"),
+				"user":    userId,
+			})).
+			Row(&unread)
+		if err != nil {
+			return nil, err
+		}
+
+		readState.Set("last_read_message", cursor.Id)
+		readState.Set("last_read_at", cursor.GetDateTime("created"))
+	}
+
+	readState.Set("unread", unread)
+	if err := dao.SaveRecord(readState); err != nil {
+		return nil, err
+	}
+
+	return readState, nil
+}
+
+// countUnreadMessage increments the unread counts of the members of the chat
+// for the new message. The sender has read the chat up to their message.
+func countUnreadMessage(dao *daos.Dao, kind *ChatKind, chatId string, memberIds []string, senderId string, messageId string) error {
+	return dao.RunInTransaction(func(txDao *daos.Dao) error {
+		for _, memberId := range memberIds {
+			if memberId == senderId {
+				if _, err := markChatRead(txDao, kind, chatId, memberId, messageId); err != nil {
+					return err
+				}
+				continue
+			}
+
+			readState, err := findReadState(txDao, kind.Identifier(chatId), memberId)
+			if err != nil {
+				return err
+			}
+
+			readState.Set("unread", readState.GetInt("unread")+1)
+			if err := txDao.SaveRecord(readState); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// countChatMessage updates the read states of the members of the message's chat.
+func countChatMessage(dao *daos.Dao, kind *ChatKind, message *models.Record, sender *models.Record) error {
+	chat, err := kind.FindChat(dao, message.GetString("chat"))
+	if err != nil {
+		return err
+	}
+
+	return countUnreadMessage(dao, kind, chat.Id, kind.MemberIds(dao, chat), sender.Id, message.Id)
+}
+
+// findUnreadTotals returns the total number of unread messages of each of the users.
+func findUnreadTotals(dao *daos.Dao, userIds []string) (map[string]int, error) {
+	totals := map[string]int{}
+	if len(userIds) == 0 {
+		return totals, nil
+	}
+
+	ids := make([]any, len(userIds))
+	for idx, userId := range userIds {
+		ids[idx] = userId
+	}
+
+	readStates, err := dao.FindRecordsByExpr("chat_read_states", dbx.In("user", ids...), dbx.NewExp("unread>0"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, readState := range readStates {
+		totals[readState.GetString("user")] += readState.GetInt("unread")
+	}
+
+	return totals, nil
+}
+
+// removeReadStates deletes the read states of the chat except the ones of the
+// users to keep, so that chats which users can no longer read do not count
+// toward their unread totals.
+func removeReadStates(dao *daos.Dao, chatIdentifier string, keepUserIds []string) error {
+	readStates, err := dao.FindRecordsByFilter("chat_read_states", "chat={:chat}", "", 0, 0, dbx.Params{
+		"chat": chatIdentifier,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, readState := range readStates {
+		if slices.Contains(keepUserIds, readState.GetString("user")) {
+			continue
+		}
+
+		if err := dao.DeleteRecord(readState); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bindReadStateCleanup removes the read states of the members who were removed
+// from a chat and of every member once the chat is deleted.
+func bindReadStateCleanup(app core.App) {
+	collectionNames := chatListCollectionNames()
+
+	app.OnModelAfterUpdate(collectionNames...).Add(func(e *core.ModelEvent) error {
+		chat, ok := e.Model.(*models.Record)
+		if !ok {
+			return nil
+		}
+
+		kind, err := findChatKindByCollection(chat.Collection().Name)
+		if err != nil {
+			return nil
+		}
+
+		// do not return error or it will cause the save to fail
+		if err := removeReadStates(e.Dao, kind.Identifier(chat.Id), kind.MemberIds(e.Dao, chat)); err != nil {
+			log.Println(err)
+		}
+		return nil
+	})
+
+	app.OnModelAfterDelete(collectionNames...).Add(func(e *core.ModelEvent) error {
+		chat, ok := e.Model.(*models.Record)
+		if !ok {
+			return nil
+		}
+
+		kind, err := findChatKindByCollection(chat.Collection().Name)
+		if err != nil {
+			return nil
+		}
+
+		if err := removeReadStates(e.Dao, kind.Identifier(chat.Id), nil); err != nil {
+			log.Println(err)
+		}
+		return nil
+	})
+}
+
+func bindReadStateApi(app core.App, e *core.ServeEvent) {
+	e.Router.Add("POST", "/api/chats/read", func(c echo.Context) error {
+		chatKind, chatId, err := decodeCallDetailsParams(c)
+		if err != nil {
+			return err
+		}
+
+		var body markReadRequest
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("invalid request body", err)
+		}
+
+		chat, err := chatKind.FindChat(app.Dao(), chatId)
+		if err != nil {
+			return apis.NewNotFoundError("chat not found", nil)
+		}
+
+		user := apis.RequestInfo(c).AuthRecord
+		if !slices.Contains(chatKind.MemberIds(app.Dao(), chat), user.Id) {
+			return apis.NewForbiddenError("forbidden to read this chat", nil)
+		}
+
+		readState, err := markChatRead(app.Dao(), chatKind, chat.Id, user.Id, body.MessageId)
+		if errors.Is(err, sql.ErrNoRows) {
+			return apis.NewNotFoundError("message not found", nil)
+		} else if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, readState)
+	}, apis.RequireRecordAuth())
+
+	e.Router.Add("GET", "/api/chats/unread", func(c echo.Context) error {
+		user := apis.RequestInfo(c).AuthRecord
+		readStates, err := app.Dao().FindRecordsByFilter("chat_read_states", "user={:user} && unread>0", "-updated", 0, 0, dbx.Params{
+			"user": user.Id,
+		})
+		if err != nil {
+			return err
+		}
+
+		total := 0
+		for _, readState := range readStates {
+			total += readState.GetInt("unread")
+		}
+
+		return c.JSON(http.StatusOK, map[string]any{
+			"total": total,
+			"chats": readStates,
+		})
+	}, apis.RequireRecordAuth())
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"golang.org/x/exp/slices"
+)
+
+// receipt events reported by the app
+const (
+	receiptEventDelivered   = "delivered"
+	receiptEventDisplayed   = "displayed"
+	receiptEventActionTaken = "action_taken"
+)
+
+var validReceiptEvents = []string{receiptEventDelivered, receiptEventDisplayed, receiptEventActionTaken}
+
+type notificationReceipt struct {
+	NotificationId string `json:"notification_id" form:"notification_id"`
+	Event          string `json:"event" form:"event"`
+	Action         string `json:"action" form:"action"`
+	Kind           string `json:"kind" form:"kind"`
+	DeviceToken    string `json:"device_token" form:"device_token"`
+}
+
+func bindReceiptApi(app core.App, e *core.ServeEvent, scheduler *NotificationScheduler) {
+	e.Router.Add("POST", "/api/notifications/receipts", func(c echo.Context) error {
+		var body notificationReceipt
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("invalid request body", err)
+		}
+
+		if len(body.NotificationId) == 0 {
+			return apis.NewBadRequestError("notification_id is required", nil)
+		}
+
+		if !slices.Contains(validReceiptEvents, body.Event) {
+			return apis.NewBadRequestError("invalid event", nil)
+		}
+
+		user := apis.RequestInfo(c).AuthRecord
+
+		notif := scheduler.FindNotification(body.NotificationId)
+		if notif == nil && scheduler.LoadDeadLetter != nil {
+			notif = scheduler.LoadDeadLetter(body.NotificationId)
+		}
+
+		if notif != nil {
+			if !slices.Contains(notif.Recipients, user.Id) {
+				return apis.NewForbiddenError("not a recipient of the notification", nil)
+			}
+
+			// prefer the kind of the notification known by the scheduler
+			// over the one reported by the app
+			if len(notif.Kind) != 0 {
+				body.Kind = notif.Kind
+			}
+		} else {
+			// notifications which are no longer known by the scheduler are only
+			// accepted from users who reported a receipt while it was known
+			previous, err := app.Dao().FindFirstRecordByFilter("notification_receipts", "notification_id={:notification_id} && user={:user}", dbx.Params{
+				"notification_id": body.NotificationId,
+				"user":            user.Id,
+			})
+			if err != nil {
+				return c.NoContent(http.StatusNoContent)
+			}
+
+			body.Kind = previous.GetString("kind")
+		}
+
+		if body.Event == receiptEventActionTaken {
+			if len(body.Action) == 0 {
+				return apis.NewBadRequestError("action is required", nil)
+			}
+
+			if kind, err := findNotificationKind(body.Kind); err == nil && !slices.Contains(kind.actionTypes(), body.Action) {
+				return apis.NewBadRequestError("invalid action", nil)
+			}
+		} else {
+			body.Action = ""
+		}
+
+		deviceId := ""
+		if len(body.DeviceToken) != 0 {
+			device, err := app.Dao().FindFirstRecordByFilter("devices", "user={:user} && (token={:token} || voip_token={:token})", dbx.Params{
+				"user":  user.Id,
+				"token": body.DeviceToken,
+			})
+			if err == nil {
+				deviceId = device.Id
+				if err := markDeviceSeen(app.Dao(), device); err != nil {
+					log.Println(err)
+				}
+			}
+		}
+
+		// receipts may be reported more than once (e.g. on app restart)
+		existing, _ := app.Dao().FindFirstRecordByFilter("notification_receipts",
+			"notification_id={:notification_id} && user={:user} && device={:device} && event={:event} && action={:action}",
+			dbx.Params{
+				"notification_id": body.NotificationId,
+				"user":            user.Id,
+				"device":          deviceId,
+				"event":           body.Event,
+				"action":          body.Action,
+			})
+		if existing != nil {
+			return c.JSON(http.StatusOK, existing)
+		}
+
+		collection, err := app.Dao().FindCollectionByNameOrId("notification_receipts")
+		if err != nil {
+			return err
+		}
+
+		receipt := models.NewRecord(collection)
+		receipt.Set("notification_id", body.NotificationId)
+		receipt.Set("kind", body.Kind)
+		receipt.Set("user", user.Id)
+		receipt.Set("device", deviceId)
+		receipt.Set("event", body.Event)
+		receipt.Set("action", body.Action)
+
+		if err := app.Dao().SaveRecord(receipt); err != nil {
+			return apis.NewBadRequestError("failed to save receipt", err)
+		}
+
+		return c.JSON(http.StatusOK, receipt)
+	}, apis.RequireRecordAuth())
+
+	e.Router.Add("GET", "/api/admin/notifications/:id/receipts", func(c echo.Context) error {
+		receipts, err := app.Dao().FindRecordsByFilter("notification_receipts", "notification_id={:id}", "created", 0, 0, dbx.Params{
+			"id": c.PathParam("id"),
+		})
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, receipts)
+	}, apis.RequireAdminAuth())
+}
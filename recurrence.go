@@ -0,0 +1,187 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pocketbase/pocketbase/tools/cron"
+)
+
+// maxRecurrenceLookahead is how far ahead the next occurrence of a
+// recurrence rule is searched for
+var maxRecurrenceLookahead = 5 * 366 * 24 * time.Hour
+
+// Recurrence repeats a scheduled notification according to a cron
+// expression (e.g. "0 9 * * 1") or an RRULE (e.g. "FREQ=WEEKLY;BYDAY=MO;BYHOUR=9").
+//
+// The rule is evaluated in the timezone of the recipients so that a
+// reminder at 9 AM arrives at 9 AM wherever they are.
+type Recurrence struct {
+	// SeriesId is shared by all of the occurrences of the notification
+	// and is used for pausing, resuming and ending the series.
+	SeriesId string
+	Rule     string
+	Location *time.Location
+
+	// Until is the time after which the series ends. The series
+	// never ends if it is zero.
+	Until time.Time
+
+	// OnDue is called instead of sending the occurrence when it is due
+	// (e.g. to send the notification to whoever the recipients are by then).
+	OnDue func(occurrence *ScheduledNotification)
+
+	schedule *cron.Schedule
+}
+
+// loadRecurrenceLocation loads the timezone in which a rule is evaluated.
+// Unknown or empty timezones fall back to UTC.
+func loadRecurrenceLocation(timezone string) *time.Location {
+	location, err := time.LoadLocation(timezone)
+	if err != nil || len(timezone) == 0 {
+		return time.UTC
+	}
+	return location
+}
+
+// NewRecurrence parses the rule and loads the timezone of the recurrence.
+func NewRecurrence(seriesId string, rule string, timezone string, until time.Time) (*Recurrence, error) {
+	schedule, ruleUntil, err := parseRecurrenceRule(rule)
+	if err != nil {
+		return nil, err
+	}
+
+	if until.IsZero() || (!ruleUntil.IsZero() && ruleUntil.Before(until)) {
+		until = ruleUntil
+	}
+
+	return &Recurrence{
+		SeriesId: seriesId,
+		Rule:     rule,
+		Location: loadRecurrenceLocation(timezone),
+		Until:    until,
+		schedule: schedule,
+	}, nil
+}
+
+// Next returns the first occurrence after the given time, or zero if the
+// series has ended.
+func (r *Recurrence) Next(after time.Time) time.Time {
+	t := after.In(r.Location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(maxRecurrenceLookahead)
+
+	for t.Before(limit) {
+		if !r.Until.IsZero() && t.After(r.Until) {
+			return time.Time{}
+		}
+
+		moment := cron.NewMoment(t)
+
+		// skip the whole day or hour when they do not match
+		// instead of checking each of their minutes
+		_, dayMatches := r.schedule.Days[moment.Day]
+		_, monthMatches := r.schedule.Months[moment.Month]
+		_, weekdayMatches := r.schedule.DaysOfWeek[moment.DayOfWeek]
+		if !dayMatches || !monthMatches || !weekdayMatches {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, r.Location)
+			continue
+		}
+
+		if _, hourMatches := r.schedule.Hours[moment.Hour]; !hourMatches {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, r.Location)
+			continue
+		}
+
+		if r.schedule.IsDue(moment) {
+			return t
+		}
+
+		t = t.Add(time.Minute)
+	}
+
+	return time.Time{}
+}
+
+var rruleWeekdays = map[string]string{
+	"SU": "0", "MO": "1", "TU": "2", "WE": "3", "TH": "4", "FR": "5", "SA": "6",
+}
+
+// parseRecurrenceRule parses a cron expression or an RRULE. RRULEs are
+// converted into their cron equivalent and only support the FREQ (daily, weekly
+// and monthly), BYDAY, BYMONTHDAY, BYHOUR, BYMINUTE and UNTIL parts.
+func parseRecurrenceRule(rule string) (*cron.Schedule, time.Time, error) {
+	rule = strings.TrimSpace(rule)
+	if !strings.Contains(rule, "FREQ=") {
+		schedule, err := cron.NewSchedule(rule)
+		return schedule, time.Time{}, err
+	}
+
+	parts := map[string]string{}
+	for _, part := range strings.Split(strings.TrimPrefix(rule, "RRULE:"), ";") {
+		key, value, found := strings.Cut(part, "=")
+		if !found {
+			return nil, time.Time{}, fmt.Errorf("invalid rrule part %q", part)
+		}
+		parts[strings.ToUpper(key)] = strings.ToUpper(value)
+	}
+
+	minute, hour, day, weekday := "0", "0", "*", "*"
+	var until time.Time
+
+	for key, value := range parts {
+		switch key {
+		case "FREQ":
+		case "BYMINUTE":
+			minute = value
+		case "BYHOUR":
+			hour = value
+		case "BYMONTHDAY":
+			day = value
+		case "BYDAY":
+			days := strings.Split(value, ",")
+			for idx, d := range days {
+				cronDay, ok := rruleWeekdays[d]
+				if !ok {
+					return nil, time.Time{}, fmt.Errorf("unsupported rrule day %q", d)
+				}
+				days[idx] = cronDay
+			}
+			weekday = strings.Join(days, ",")
+		case "INTERVAL":
+			if interval, err := strconv.Atoi(value); err != nil || interval != 1 {
+				return nil, time.Time{}, errors.New("rrule intervals are not supported")
+			}
+		case "UNTIL":
+			parsed, err := time.Parse("20060102T150405Z", value)
+			if err != nil {
+				parsed, err = time.Parse("20060102", value)
+			}
+			if err != nil {
+				return nil, time.Time{}, fmt.Errorf("invalid rrule until %q", value)
+			}
+			until = parsed
+		default:
+			return nil, time.Time{}, fmt.Errorf("unsupported rrule part %q", key)
+		}
+	}
+
+	switch parts["FREQ"] {
+	case "DAILY":
+	case "WEEKLY":
+		if weekday == "*" {
+			return nil, time.Time{}, errors.New("weekly rrules require BYDAY")
+		}
+	case "MONTHLY":
+		if day == "*" {
+			return nil, time.Time{}, errors.New("monthly rrules require BYMONTHDAY")
+		}
+	default:
+		return nil, time.Time{}, fmt.Errorf("unsupported rrule frequency %q", parts["FREQ"])
+	}
+
+	schedule, err := cron.NewSchedule(strings.Join([]string{minute, hour, day, "*", weekday}, " "))
+	return schedule, until, err
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"golang.org/x/exp/slices"
+)
+
+// community reminders are stored in the notification_schedules collection:
+//
+//   - chat: the community chat (chat_list_gc) whose members receive the reminder
+//   - message: the body of the reminder
+//   - rule: a cron expression or an RRULE evaluated in each member's timezone
+//   - until: the optional end of the series
+//   - paused: stops the reminder from being sent until it is unpaused
+//
+// The id of the record is used as the series id of the scheduled notifications.
+
+// scheduleCommunityReminder schedules the series of the reminder. The members
+// of the chat are looked up each time the reminder is due so that members who
+// joined or left the chat since are included or left out.
+func scheduleCommunityReminder(app core.App, scheduler *NotificationScheduler, schedule *models.Record) error {
+	chat, err := communityChatKind.FindChat(app.Dao(), schedule.GetString("chat"))
+	if err != nil {
+		return err
+	}
+
+	app.Dao().ExpandRecord(chat, communityChatKind.Expands, nil)
+	community := chat.ExpandedOne("community")
+	if community == nil {
+		return fmt.Errorf("community of chat %s not found", chat.Id)
+	}
+
+	imageUrl := ""
+	if avatar := community.GetString("avatar"); len(avatar) != 0 {
+		gotImageUrl, err := url.JoinPath(app.Settings().Meta.AppUrl, "api/files", community.Collection().Id, community.Id, avatar)
+		if err == nil {
+			imageUrl = gotImageUrl
+		}
+	}
+
+	findMembers := func() []*models.Record {
+		chat, err := communityChatKind.FindChat(app.Dao(), schedule.GetString("chat"))
+		if err != nil {
+			log.Printf("Error finding the chat of reminder %s: %v\n", schedule.Id, err)
+			return nil
+		}
+
+		members, err := app.Dao().FindRecordsByIds("users", communityChatKind.MemberIds(app.Dao(), chat))
+		if err != nil {
+			log.Printf("Error finding the members of reminder %s: %v\n", schedule.Id, err)
+			return nil
+		}
+
+		return members
+	}
+
+	// the series repeats in the timezones of the current members.
+	// it is scheduled again whenever the members of the chat change
+	timezones := []string{}
+	for _, target := range findPushTargets(app.Dao(), findMembers()) {
+		timezones = append(timezones, target.Timezone)
+	}
+
+	return scheduleRecurringNotification(scheduler, schedule.Id, CommunityReminderParams{
+		CommunityName:     community.GetString("name"),
+		CommunityImageUrl: imageUrl,
+		Message:           schedule.GetString("message"),
+		ChatId:            chat.Id,
+		ScheduleId:        schedule.Id,
+	}, timezones, func() []pushTarget {
+		return findPushTargets(app.Dao(), findMembers())
+	}, schedule.GetString("rule"), schedule.GetDateTime("until").Time())
+}
+
+// syncCommunityReminder updates the scheduled series of the reminder
+// to match its record.
+func syncCommunityReminder(app core.App, scheduler *NotificationScheduler, schedule *models.Record) error {
+	original := schedule.OriginalCopy()
+	onlyPauseChanged := original.GetString("chat") == schedule.GetString("chat") &&
+		original.GetString("message") == schedule.GetString("message") &&
+		original.GetString("rule") == schedule.GetString("rule") &&
+		original.GetDateTime("until").String() == schedule.GetDateTime("until").String()
+
+	// keep the scheduled occurrences when the reminder is only paused or resumed
+	if onlyPauseChanged && schedule.GetBool("paused") && scheduler.PauseSeries(schedule.Id) {
+		return nil
+	} else if onlyPauseChanged && !schedule.GetBool("paused") && scheduler.ResumeSeries(schedule.Id) {
+		return nil
+	}
+
+	scheduler.EndSeries(schedule.Id)
+	if schedule.GetBool("paused") {
+		return nil
+	}
+
+	return scheduleCommunityReminder(app, scheduler, schedule)
+}
+
+func bindCommunityReminders(app core.App, scheduler *NotificationScheduler) error {
+	schedules, err := app.Dao().FindRecordsByFilter("notification_schedules", "paused=false", "", 0, 0)
+	if err != nil {
+		return err
+	}
+
+	for _, schedule := range schedules {
+		if err := scheduleCommunityReminder(app, scheduler, schedule); err != nil {
+			log.Printf("Error scheduling reminder %s: %v\n", schedule.Id, err)
+		}
+	}
+
+	validateSchedule := func(e *core.ModelEvent) error {
+		if schedule, ok := e.Model.(*models.Record); ok {
+			if _, _, err := parseRecurrenceRule(schedule.GetString("rule")); err != nil {
+				return apis.NewBadRequestError("invalid rule", err)
+			}
+		}
+		return nil
+	}
+
+	app.OnModelBeforeCreate("notification_schedules").Add(validateSchedule)
+	app.OnModelBeforeUpdate("notification_schedules").Add(validateSchedule)
+
+	app.OnModelAfterCreate("notification_schedules").Add(func(e *core.ModelEvent) error {
+		if schedule, ok := e.Model.(*models.Record); ok && !schedule.GetBool("paused") {
+			if err := scheduleCommunityReminder(app, scheduler, schedule); err != nil {
+				log.Printf("Error scheduling reminder %s: %v\n", schedule.Id, err)
+			}
+		}
+		return nil
+	})
+
+	app.OnModelAfterUpdate("notification_schedules").Add(func(e *core.ModelEvent) error {
+		if schedule, ok := e.Model.(*models.Record); ok {
+			if err := syncCommunityReminder(app, scheduler, schedule); err != nil {
+				log.Printf("Error scheduling reminder %s: %v\n", schedule.Id, err)
+			}
+		}
+		return nil
+	})
+
+	app.OnModelAfterDelete("notification_schedules").Add(func(e *core.ModelEvent) error {
+		scheduler.EndSeries(e.Model.GetId())
+		return nil
+	})
+
+	// the reminders are scheduled again whenever the timezones of
+	// their recipients may have changed
+	reschedule := func(dao *daos.Dao, filter string, params dbx.Params) {
+		schedules, err := dao.FindRecordsByFilter("notification_schedules", "paused=false && ("+filter+")", "", 0, 0, params)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, schedule := range schedules {
+			scheduler.EndSeries(schedule.Id)
+			if err := scheduleCommunityReminder(app, scheduler, schedule); err != nil {
+				log.Printf("Error scheduling reminder %s: %v\n", schedule.Id, err)
+			}
+		}
+	}
+
+	rescheduleUser := func(dao *daos.Dao, userId string) {
+		reschedule(dao, "chat.community.users={:user} || chat.parents.users?={:user}", dbx.Params{"user": userId})
+	}
+
+	// members may have joined from a timezone which the reminders of the chat
+	// are not scheduled in yet
+	app.OnModelAfterUpdate(communityChatKind.Collection).Add(func(e *core.ModelEvent) error {
+		reschedule(e.Dao, "chat={:chat}", dbx.Params{"chat": e.Model.GetId()})
+		return nil
+	})
+
+	// devices have their own timezone
+	app.OnModelAfterCreate("devices").Add(func(e *core.ModelEvent) error {
+		if device, ok := e.Model.(*models.Record); ok {
+			rescheduleUser(e.Dao, device.GetString("user"))
+		}
+		return nil
+	})
+
+	app.OnModelAfterUpdate("devices").Add(func(e *core.ModelEvent) error {
+		if device, ok := e.Model.(*models.Record); ok {
+			original := device.OriginalCopy()
+			if original.GetString("timezone") != device.GetString("timezone") || original.GetString("user") != device.GetString("user") {
+				rescheduleUser(e.Dao, original.GetString("user"))
+				rescheduleUser(e.Dao, device.GetString("user"))
+			}
+		}
+		return nil
+	})
+
+	app.OnModelAfterDelete("devices").Add(func(e *core.ModelEvent) error {
+		if device, ok := e.Model.(*models.Record); ok {
+			rescheduleUser(e.Dao, device.GetString("user"))
+		}
+		return nil
+	})
+
+	// the timezone of the user is used by their legacy tokens
+	// and their devices without a timezone
+	app.OnModelAfterUpdate("users").Add(func(e *core.ModelEvent) error {
+		if user, ok := e.Model.(*models.Record); ok {
+			original := user.OriginalCopy()
+			changed := original.GetString("timezone") != user.GetString("timezone")
+			for _, field := range pushTokenFields {
+				changed = changed || !slices.Equal(original.GetStringSlice(field), user.GetStringSlice(field))
+			}
+
+			if changed {
+				rescheduleUser(e.Dao, user.Id)
+			}
+		}
+		return nil
+	})
+
+	return nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+	"github.com/spf13/cobra"
+)
+
+// seedPasswordLength is the length of the generated passwords of the seeded users
+const seedPasswordLength = 16
+
+// seedEnv is the value of APP_ENV where seeding is allowed without --force
+const seedEnv = "development"
+
+// seedUser is a seeded user along with its parent or community profile and
+// its device. The ids are fixed so that seeding again updates the same records.
+type seedUser struct {
+	Id        string
+	ProfileId string
+	DeviceId  string
+	Username  string
+	Name      string
+	Label     string
+	Locale    string
+	Timezone  string
+	Profile   map[string]any
+}
+
+var seedUsers = []seedUser{
+	{
+		Id:        "seeduser0maria1",
+		ProfileId: "seedparentmaria",
+		DeviceId:  "seeddevicemaria",
+		Username:  "maria",
+		Name:      "Maria Santos",
+		Label:     "parent",
+		Locale:    "fil",
+		Timezone:  "Asia/Manila",
+		Profile:   map[string]any{"first_name": "Maria", "middle_name": "Cruz", "last_name": "Santos"},
+	},
+	{
+		Id:        "seeduser00jose1",
+		ProfileId: "seedparent0jose",
+		DeviceId:  "seeddevice0jose",
+		Username:  "jose",
+		Name:      "Jose Reyes",
+		Label:     "parent",
+		Locale:    "en",
+		Timezone:  "Asia/Manila",
+		Profile:   map[string]any{"first_name": "Jose", "middle_name": "", "last_name": "Reyes"},
+	},
+	{
+		Id:        "seeduser000ana1",
+		ProfileId: "seedparent00ana",
+		DeviceId:  "seeddevice00ana",
+		Username:  "ana",
+		Name:      "Ana Garcia",
+		Label:     "parent",
+		Locale:    "en",
+		Timezone:  "America/Los_Angeles",
+		Profile:   map[string]any{"first_name": "Ana", "middle_name": "Lopez", "last_name": "Garcia"},
+	},
+	{
+		Id:        "seeduser0sunny1",
+		ProfileId: "seedcommunity01",
+		DeviceId:  "seeddevicesunny",
+		Username:  "sunrise",
+		Name:      "Sunrise Parents Club",
+		Label:     "community",
+		Locale:    "en",
+		Timezone:  "Asia/Manila",
+		Profile:   map[string]any{"name": "Sunrise Parents Club"},
+	},
+}
+
+// seedRecord is a seeded record of a collection.
+type seedRecord struct {
+	Collection string
+	Id         string
+	Data       map[string]any
+}
+
+// seedChats are the chats between the seeded users
+var seedChats = []seedRecord{
+	{dsChatKind.Collection, "seedchatds00001", map[string]any{
+		"chatRequestBy": "seedparentmaria",
+		"chatRequestTo": "seedparent0jose",
+		"status":        chatRequestStatusAccepted,
+	}},
+	{dsChatKind.Collection, "seedchatds00002", map[string]any{
+		"chatRequestBy": "seedparent00ana",
+		"chatRequestTo": "seedparentmaria",
+		"status":        chatRequestStatusPending,
+	}},
+	{parentChatKind.Collection, "seedchatparent1", map[string]any{
+		"parents": []string{"seedparentmaria", "seedparent0jose", "seedparent00ana"},
+	}},
+	{communityChatKind.Collection, "seedchatgc00001", map[string]any{
+		"community": "seedcommunity01",
+		"parents":   []string{"seedparentmaria", "seedparent0jose", "seedparent00ana"},
+	}},
+}
+
+// seedCallRoom is the active call of the accepted ds chat which Maria started
+var seedCallRoom = seedRecord{"call_rooms", "seedcallroom001", map[string]any{
+	"from_chat":            dsChatKind.Identifier("seedchatds00001"),
+	"invited_participants": []string{"seeduser0maria1", "seeduser00jose1"},
+	"participants":         []string{"seeduser0maria1"},
+	"hosts":                []string{"seeduser0maria1"},
+}}
+
+// findOrNewRecord returns the record with the id or a new record with the id.
+func findOrNewRecord(dao *daos.Dao, collectionName string, id string) (*models.Record, error) {
+	record, err := dao.FindRecordById(collectionName, id)
+	if err == nil {
+		return record, nil
+	}
+
+	collection, err := dao.FindCollectionByNameOrId(collectionName)
+	if err != nil {
+		return nil, err
+	}
+
+	record = models.NewRecord(collection)
+	record.SetId(id)
+	return record, nil
+}
+
+// saveSeedRecord creates the record or updates it to match its seeded data.
+func saveSeedRecord(dao *daos.Dao, seed seedRecord) error {
+	record, err := findOrNewRecord(dao, seed.Collection, seed.Id)
+	if err != nil {
+		return err
+	}
+
+	record.Load(seed.Data)
+	return dao.SaveRecord(record)
+}
+
+// saveSeedUser creates or updates the user, its profile and its device.
+// The password of the user is replaced with the given one.
+func saveSeedUser(dao *daos.Dao, seed seedUser, password string) error {
+	user, err := findOrNewRecord(dao, "users", seed.Id)
+	if err != nil {
+		return err
+	}
+
+	if user.IsNew() {
+		user.RefreshTokenKey()
+	}
+
+	user.SetUsername(seed.Username)
+	user.SetEmail(seed.Username + "@chumspace.test")
+	user.SetEmailVisibility(false)
+	user.SetVerified(true)
+	if err := user.SetPassword(password); err != nil {
+		return err
+	}
+
+	user.Set("name", seed.Name)
+	user.Set("label", seed.Label)
+	user.Set("locale", seed.Locale)
+	user.Set("timezone", seed.Timezone)
+
+	if err := dao.SaveRecord(user); err != nil {
+		return err
+	}
+
+	profile := seedRecord{"users_" + seed.Label, seed.ProfileId, map[string]any{"users": seed.Id}}
+	for key, value := range seed.Profile {
+		profile.Data[key] = value
+	}
+
+	if err := saveSeedRecord(dao, profile); err != nil {
+		return err
+	}
+
+	// the tokens are not real so the notifications are best
+	// observed with PUSH_TRANSPORT=memory
+	return saveSeedRecord(dao, seedRecord{"devices", seed.DeviceId, map[string]any{
+		"user":        seed.Id,
+		"token":       "seed-token-" + seed.Username,
+		"platform":    platformAndroid,
+		"transport":   transportFCM,
+		"app_version": "seed",
+		"locale":      seed.Locale,
+		"timezone":    seed.Timezone,
+		"last_seen":   types.NowDateTime(),
+	}})
+}
+
+// resetSeed deletes the seeded records. The records which belong to the
+// seeded users (e.g. their profiles, chats and messages) are deleted along
+// with them.
+func resetSeed(dao *daos.Dao) error {
+	records := []seedRecord{seedCallRoom}
+	for idx := len(seedChats) - 1; idx >= 0; idx-- {
+		records = append(records, seedChats[idx])
+	}
+
+	for _, user := range seedUsers {
+		records = append(records, seedRecord{Collection: "users", Id: user.Id})
+	}
+
+	for _, seed := range records {
+		record, err := dao.FindRecordById(seed.Collection, seed.Id)
+		if err != nil {
+			continue
+		}
+
+		if err := dao.DeleteRecord(record); err != nil {
+			return fmt.Errorf("failed to delete %s %s: %w", seed.Collection, seed.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// seedData creates the seeded users, chats and optionally an active call.
+// The users are given new random passwords which are returned by username.
+func seedData(dao *daos.Dao, withCall bool) (map[string]string, error) {
+	passwords := map[string]string{}
+	for _, user := range seedUsers {
+		password := security.RandomString(seedPasswordLength)
+		if err := saveSeedUser(dao, user, password); err != nil {
+			return nil, fmt.Errorf("failed to seed user %s: %w", user.Username, err)
+		}
+		passwords[user.Username] = password
+	}
+
+	for _, chat := range seedChats {
+		if err := saveSeedRecord(dao, chat); err != nil {
+			return nil, fmt.Errorf("failed to seed %s %s: %w", chat.Collection, chat.Id, err)
+		}
+	}
+
+	if withCall {
+		if err := saveSeedRecord(dao, seedCallRoom); err != nil {
+			return nil, fmt.Errorf("failed to seed the call: %w", err)
+		}
+	}
+
+	return passwords, nil
+}
+
+// newSeedCommand returns the command which seeds a local instance with a dataset
+// for exercising the chat and call routes. Seeding again updates the seeded
+// records instead of duplicating them.
+//
+// The seeded users have well-known usernames so the command refuses to run
+// outside of development unless it is forced.
+func newSeedCommand(app core.App) *cobra.Command {
+	var reset bool
+	var withCall bool
+	var force bool
+
+	command := &cobra.Command{
+		Use:   "seed",
+		Short: "Seeds the database with parents, a community, their chats and devices",
+		Long: "Seeds the database with parents, a community, their chats and devices.\n\n" +
+			"Only runs when APP_ENV=" + seedEnv + " unless --force is set.\n" +
+			"The seeded users are given new random passwords on every run, which are printed once seeded.\n" +
+			"The device tokens are not real so run the app with PUSH_TRANSPORT=memory to observe the notifications.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if env := os.Getenv("APP_ENV"); env != seedEnv && !force {
+				return fmt.Errorf("refusing to seed with APP_ENV=%q, set APP_ENV=%s or use --force", env, seedEnv)
+			}
+
+			// the collections are created by the migrations
+			runner, err := migrate.NewRunner(app.DB(), migrations.AppMigrations)
+			if err != nil {
+				return err
+			}
+
+			if _, err := runner.Up(); err != nil {
+				return err
+			}
+
+			var passwords map[string]string
+			err = app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+				if reset {
+					if err := resetSeed(txDao); err != nil {
+						return err
+					}
+					log.Println("Removed the seeded records")
+				}
+
+				passwords, err = seedData(txDao, withCall)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			log.Printf("Seeded %d users and %d chats\n", len(seedUsers), len(seedChats))
+			if withCall {
+				log.Printf("Seeded an active call in %s\n", seedCallRoom.Data["from_chat"])
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintln(out, "Credentials of the seeded users:")
+			for _, user := range seedUsers {
+				fmt.Fprintf(out, "  %-10s %-9s %s\n", user.Username, user.Label, passwords[user.Username])
+			}
+
+			return nil
+		},
+	}
+
+	command.Flags().BoolVar(&reset, "reset", false, "remove the seeded records before seeding them again")
+	command.Flags().BoolVar(&withCall, "call", false, "also seed an active call in the accepted ds chat")
+	command.Flags().BoolVar(&force, "force", false, "seed even if APP_ENV is not "+seedEnv)
+
+	return command
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"firebase.google.com/go/v4/messaging"
+	gonanoid "github.com/matoous/go-nanoid/v2"
+)
+
+// names of the push transports
+const (
+	transportFCM         = "fcm"
+	transportAPNSVoIP    = "apns_voip"
+	transportUnifiedPush = "unifiedpush"
+)
+
+// PushTransport delivers messages to the tokens of a push service.
+//
+// The messages are built using the FCM message types regardless of the
+// transport. Each transport only uses the parts of the message that
+// apply to it.
+type PushTransport interface {
+	Send(ctx context.Context, message *messaging.Message) (string, error)
+	SendEachForMulticast(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error)
+}
+
+// FCM and APNs clients are transports
+var _ PushTransport = (*messaging.Client)(nil)
+var _ PushTransport = (*APNSClient)(nil)
+
+// sendEachForMulticast sends the multicast message by sending a message to each of
+// its tokens. It is used by transports that have no native multicast support.
+func sendEachForMulticast(ctx context.Context, transport PushTransport, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	resp := &messaging.BatchResponse{
+		Responses: make([]*messaging.SendResponse, len(message.Tokens)),
+	}
+
+	for idx, token := range message.Tokens {
+		id, err := transport.Send(ctx, &messaging.Message{
+			Data:         message.Data,
+			Notification: message.Notification,
+			Android:      message.Android,
+			Webpush:      message.Webpush,
+			APNS:         message.APNS,
+			Token:        token,
+		})
+		if err != nil {
+			resp.FailureCount++
+			resp.Responses[idx] = &messaging.SendResponse{Error: err}
+			continue
+		}
+
+		resp.SuccessCount++
+		resp.Responses[idx] = &messaging.SendResponse{Success: true, MessageID: id}
+	}
+
+	return resp, nil
+}
+
+// RecordingTransport keeps the sent messages in memory instead of
+// delivering them. It is used for tests and local development.
+type RecordingTransport struct {
+	mutex    sync.Mutex
+	Messages []*messaging.Message
+
+	// FailingTokens makes the sends to the token fail with the error
+	FailingTokens map[string]error
+}
+
+var _ PushTransport = (*RecordingTransport)(nil)
+
+func NewRecordingTransport() *RecordingTransport {
+	return &RecordingTransport{
+		FailingTokens: map[string]error{},
+	}
+}
+
+func (t *RecordingTransport) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if err, failing := t.FailingTokens[message.Token]; failing {
+		return "", err
+	}
+
+	t.Messages = append(t.Messages, message)
+	log.Default().Printf("[recording] %s: %v\n", message.Token, message.Data)
+
+	id, _ := gonanoid.New()
+	return id, nil
+}
+
+func (t *RecordingTransport) SendEachForMulticast(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return sendEachForMulticast(ctx, t, message)
+}
+
+// SentMessages returns the messages sent to the token.
+func (t *RecordingTransport) SentMessages(token string) []*messaging.Message {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	messages := []*messaging.Message{}
+	for _, message := range t.Messages {
+		if message.Token == token {
+			messages = append(messages, message)
+		}
+	}
+
+	return messages
+}
+
+// TransportNotConfiguredError is the error of a notification whose
+// transport is not configured. Retrying does not help so the
+// notification is dead lettered right away.
+type TransportNotConfiguredError struct {
+	Transport string
+}
+
+func (e *TransportNotConfiguredError) Error() string {
+	return fmt.Sprintf("transport %q is not configured", e.Transport)
+}
+
+func (e *TransportNotConfiguredError) IsRetryable() bool {
+	return false
+}
+
+// UnifiedPushError is the error returned by a UnifiedPush server for a rejected push.
+type UnifiedPushError struct {
+	Status int
+}
+
+func (e *UnifiedPushError) Error() string {
+	return fmt.Sprintf("unifiedpush error %d", e.Status)
+}
+
+// IsInvalidToken checks if the endpoint no longer exists.
+func (e *UnifiedPushError) IsInvalidToken() bool {
+	return e.Status == http.StatusNotFound || e.Status == http.StatusGone
+}
+
+func (e *UnifiedPushError) IsRetryable() bool {
+	return e.Status == http.StatusTooManyRequests || e.Status >= 500
+}
+
+// maxUnifiedPushResponseSize is how much of the response of a UnifiedPush
+// server is read. The response is only drained so that the connection can
+// be reused.
+var maxUnifiedPushResponseSize int64 = 64 * 1024
+
+// UnifiedPushEndpointError is the error of an endpoint which pushes are not
+// sent to, e.g. one that is not https or resolves to a private address.
+type UnifiedPushEndpointError struct {
+	Endpoint string
+	Reason   string
+}
+
+func (e *UnifiedPushEndpointError) Error() string {
+	return fmt.Sprintf("unifiedpush endpoint %q is not allowed: %s", e.Endpoint, e.Reason)
+}
+
+// IsInvalidToken reports the endpoint as invalid so that it is removed.
+func (e *UnifiedPushEndpointError) IsInvalidToken() bool {
+	return true
+}
+
+func (e *UnifiedPushEndpointError) IsRetryable() bool {
+	return false
+}
+
+// parseUnifiedPushEndpoint parses the endpoint of a device, which must be https.
+func parseUnifiedPushEndpoint(endpoint string) (*url.URL, error) {
+	parsed, err := url.Parse(endpoint)
+	if err != nil || len(parsed.Host) == 0 {
+		return nil, &UnifiedPushEndpointError{Endpoint: endpoint, Reason: "invalid url"}
+	} else if parsed.Scheme != "https" {
+		return nil, &UnifiedPushEndpointError{Endpoint: endpoint, Reason: "not https"}
+	}
+	return parsed, nil
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (100.64.0.0/10), which
+// is not public either.
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP checks if the ip can be reached from the internet.
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsMulticast() &&
+		!ip.IsUnspecified() &&
+		!sharedAddressSpace.Contains(ip)
+}
+
+// UnifiedPushTransport delivers messages to UnifiedPush (e.g. ntfy) endpoints
+// for devices without Google Play services. The token of the device is its
+// endpoint url and the data of the message is posted to it as JSON.
+//
+// The endpoints are registered by the clients, so only https endpoints which
+// resolve to public addresses are pushed to. The address is checked when the
+// connection is made so that it also applies to redirects and to hosts which
+// resolve to a different address each time.
+type UnifiedPushTransport struct {
+	httpClient *http.Client
+}
+
+var _ PushTransport = (*UnifiedPushTransport)(nil)
+
+func NewUnifiedPushTransport() *UnifiedPushTransport {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network string, address string, conn syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return &UnifiedPushEndpointError{Endpoint: address, Reason: "not a public address"}
+			}
+			return nil
+		},
+	}
+
+	return &UnifiedPushTransport{
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+			Transport: &http.Transport{
+				// a proxy would make the connections instead of the dialer
+				Proxy:               nil,
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: 10 * time.Second,
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     90 * time.Second,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= 5 {
+					return errors.New("too many redirects")
+				} else if req.URL.Scheme != "https" {
+					return &UnifiedPushEndpointError{Endpoint: req.URL.String(), Reason: "redirected to a non-https url"}
+				}
+				return nil
+			},
+		},
+	}
+}
+
+func (t *UnifiedPushTransport) Send(ctx context.Context, message *messaging.Message) (string, error) {
+	if len(message.Token) == 0 {
+		return "", errors.New("message has no endpoint")
+	}
+
+	endpoint, err := parseUnifiedPushEndpoint(message.Token)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(message.Data)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if message.Android != nil {
+		if message.Android.TTL != nil {
+			req.Header.Set("TTL", strconv.Itoa(int(message.Android.TTL.Seconds())))
+		}
+
+		if message.Android.Priority == "high" {
+			req.Header.Set("Urgency", "high")
+		}
+	}
+
+	res, err := t.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	// the body is not used, only drained up to a limit
+	io.Copy(io.Discard, io.LimitReader(res.Body, maxUnifiedPushResponseSize))
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return "", &UnifiedPushError{Status: res.StatusCode}
+	}
+
+	return res.Header.Get("Location"), nil
+}
+
+func (t *UnifiedPushTransport) SendEachForMulticast(ctx context.Context, message *messaging.MulticastMessage) (*messaging.BatchResponse, error) {
+	return sendEachForMulticast(ctx, t, message)
+}